@@ -1,9 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
+	"regexp"
+	"runtime"
+	"strings"
 
 	"github.com/debedb/fxforce5/fxforce5"
 )
@@ -21,20 +26,184 @@ import (
 // 	return nil
 // }
 
+// groupRules collects repeated -group flags.
+type groupRules []fxforce5.GroupRule
+
+func (g *groupRules) String() string {
+	rules := make([]string, 0, len(*g))
+	for _, rule := range *g {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, ",")
+}
+
+func (g *groupRules) Set(s string) error {
+	rule, err := fxforce5.ParseGroupRule(s)
+	if err != nil {
+		return err
+	}
+	*g = append(*g, rule)
+	return nil
+}
+
+// Logger of the run, writing to stderr, as the report goes to stdout.
+var logger *slog.Logger
+
+// fatalf logs the message as an error and exits.
+func fatalf(format string, args ...interface{}) {
+	logger.Error(fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// newLogger returns a text logger writing to stderr at the level, without
+// timestamps.
+func newLogger(level slog.Level) *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) == 0 && attr.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return attr
+		},
+	}))
+}
+
 // TODO command line options
 func main() {
-	log.SetOutput(os.Stderr)
-	log.SetOutput(os.Stdout)
+	var groups groupRules
+	flag.Var(&groups, "group", "put providers of types implementing an interface into a value group, as Interface=group (repeatable)")
+	var ctorPatterns []*regexp.Regexp
+	flag.Func("ctor-pattern", "regular expression for constructor names (repeatable, default "+fxforce5.DEFAULT_CTOR_PATTERN+")", func(s string) error {
+		pattern, err := regexp.Compile(s)
+		if err != nil {
+			return err
+		}
+		ctorPatterns = append(ctorPatterns, pattern)
+		return nil
+	})
+	fxVersion := flag.String("fx-version", fxforce5.DEFAULT_FX_VERSION, "version of go.uber.org/fx to require in go.mod")
+	diutilsVersion := flag.String("diutils-version", "", "import diutils from the fxforce5 module at this version, instead of from the rewritten module")
+	diutilsDir := flag.String("diutils-dir", fxforce5.DEFAULT_DIUTILS_DIR, "directory, relative to the module root, to copy the diutils package into")
+	testPolicy := flag.String("tests", string(fxforce5.TEST_FILES_SKIP), "what to do with _test.go files: "+string(fxforce5.TEST_FILES_SKIP)+" to leave them alone, "+string(fxforce5.TEST_FILES_UPDATE)+" to have them call the original constructors")
+	tags := flag.String("tags", "", "comma-separated build tags to load packages with, as for go build")
+	var includes, excludes, pkgPatterns []string
+	flag.Func("include", "only rewrite files matching this glob, relative to the directory, ** matching any number of directories (repeatable)", func(s string) error {
+		includes = append(includes, s)
+		return nil
+	})
+	flag.Func("exclude", "do not rewrite files or directories matching this glob, e.g. internal/**/mocks/*.go (repeatable)", func(s string) error {
+		excludes = append(excludes, s)
+		return nil
+	})
+	flag.Func("packages", "only rewrite the packages matching these comma-separated patterns, e.g. example.com/x/internal/... or ./internal/... (repeatable)", func(s string) error {
+		pkgPatterns = append(pkgPatterns, strings.Split(s, ",")...)
+		return nil
+	})
+	var transformations []fxforce5.Transformation
+	transformNames := make([]string, 0, len(fxforce5.TRANSFORMATIONS))
+	for _, t := range fxforce5.TRANSFORMATIONS {
+		transformNames = append(transformNames, string(t))
+	}
+	transformSet := false
+	flag.Func("transform", "only apply these comma-separated transformations, among "+strings.Join(transformNames, ", ")+", or none if empty (repeatable, default all)", func(s string) error {
+		transformSet = true
+		for _, name := range strings.Split(s, ",") {
+			if name == "" {
+				continue
+			}
+			t, err := fxforce5.ParseTransformation(name)
+			if err != nil {
+				return err
+			}
+			transformations = append(transformations, t)
+		}
+		return nil
+	})
+	jobs := flag.Int("j", runtime.GOMAXPROCS(0), "number of packages to analyze concurrently")
+	cacheDir := flag.String("cache-dir", fxforce5.DefaultCacheDir(), "directory to cache the results of the analysis of packages in, skipping the rewrite of unchanged packages (all packages are still loaded); empty to disable")
+	format := flag.String("format", "text", "format of the report printed to stdout: text, json, or none")
+	keepGoing := flag.Bool("keep-going", false, "rewrite the files without errors when other files have errors, rather than stop before writing anything")
+	gitignore := flag.Bool("gitignore", false, "do not rewrite files ignored by .gitignore files")
+	verbose := flag.Bool("v", false, "log what is found and decided along the way")
+	quiet := flag.Bool("q", false, "only log errors")
 	flag.Parse()
 
-	if len(flag.Args()) != 1 {
-		log.Fatal("For usage: fxforce5 -h")
+	level := slog.LevelInfo
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	if *quiet {
+		level = slog.LevelError
+	}
+	logger = newLogger(level)
+	if *verbose && *quiet {
+		fatalf("-v and -q are exclusive")
+	}
+	if len(flag.Args()) > 1 {
+		fatalf("For usage: fxforce5 -h")
+	}
+	if *format != "text" && *format != "json" && *format != "none" {
+		fatalf("Invalid -format %q, expected text, json or none", *format)
+	}
+	// A directory in the module, or a pattern such as ./...
+	srcRoot := "./..."
+	if len(flag.Args()) == 1 {
+		srcRoot = flag.Args()[0]
+	}
+	logger.Info(fmt.Sprintf("Analyzing %s", srcRoot))
+	opts := []fxforce5.Option{fxforce5.WithLogger(logger)}
+	if len(includes) > 0 {
+		opts = append(opts, fxforce5.WithInclude(includes...))
+	}
+	if len(pkgPatterns) > 0 {
+		opts = append(opts, fxforce5.WithPackages(pkgPatterns...))
+	}
+	if *gitignore {
+		opts = append(opts, fxforce5.WithGitignore())
+	}
+	if *keepGoing {
+		opts = append(opts, fxforce5.WithKeepGoing())
+	}
+	if transformSet {
+		opts = append(opts, fxforce5.WithTransformations(transformations...))
+	}
+	for _, rule := range groups {
+		opts = append(opts, fxforce5.WithGroupRule(rule))
+	}
+	for _, pattern := range ctorPatterns {
+		opts = append(opts, fxforce5.WithConstructorPattern(pattern))
+	}
+	opts = append(opts, fxforce5.WithJobs(*jobs))
+	opts = append(opts, fxforce5.WithCacheDir(*cacheDir))
+	opts = append(opts, fxforce5.WithFxVersion(*fxVersion))
+	opts = append(opts, fxforce5.WithDiutilsDir(*diutilsDir))
+	switch policy := fxforce5.TestFilePolicy(*testPolicy); policy {
+	case fxforce5.TEST_FILES_SKIP, fxforce5.TEST_FILES_UPDATE:
+		opts = append(opts, fxforce5.WithTestFiles(policy))
+	default:
+		fatalf("Invalid -tests %q, expected %s or %s", *testPolicy, fxforce5.TEST_FILES_SKIP, fxforce5.TEST_FILES_UPDATE)
+	}
+	if *tags != "" {
+		opts = append(opts, fxforce5.WithBuildTags(strings.Split(*tags, ",")...))
+	}
+	if *diutilsVersion != "" {
+		opts = append(opts, fxforce5.WithDiutilsVersion(*diutilsVersion))
+	}
+	analyzer := fxforce5.NewAnalyzer(srcRoot, excludes, opts...)
+	report, err := analyzer.Analyze()
+	switch *format {
+	case "text":
+		report.WriteText(os.Stdout)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	}
+	if err != nil {
+		if report.Errors() > 0 && !*keepGoing {
+			fatalf("%s, nothing written; -keep-going rewrites the other files", err)
+		}
+		fatalf("%s", err)
 	}
-	srcRoot := flag.Args()[0]
-	log.Printf("Analyzing %s", srcRoot)
-	// TODO add as a pattern, to skip things like /generated/**.go
-	// ignores := []string{"internal/dependencies.go"}
-	analyzer := fxforce5.NewAnalyzer(srcRoot, nil)
-	analyzer.Analyze()
-
 }
@@ -2,10 +2,27 @@
 package diutils
 
 import (
+	"fmt"
 	"reflect"
+	"strings"
+	"unsafe"
 	// "go.uber.org/fx"
 )
 
+const (
+	// Name of the struct tag on params fields that controls how they are
+	// mapped onto the fields of the constructed struct.
+	//
+	//	Name    string  `diutils:"target=name"`             // copied into field "name"
+	//	Primary *sql.DB `diutils:"target=dbs,key=primary"` // stored as dbs["primary"]
+	//	Logger  Logger  `diutils:"-"`                       // not copied at all
+	TAG = "diutils"
+
+	tagSkip   = "-"
+	tagTarget = "target"
+	tagKey    = "key"
+)
+
 // Sample usage:
 //
 // type DependenciesType struct {
@@ -25,17 +42,61 @@ import (
 //		retval := utils.Construct[DependenciesParams, DependenciesType](params)
 //		return retval
 //	}
+//
+// After the fields are copied, defaults are applied and the result is
+// validated (see finish()). Construct panics if that fails; use
+// ConstructErr() to have fx report the error at startup instead.
 func Construct[P any, T any, PT interface{ *T }](params P) PT {
-	p := PT(new(T))
-	construct0(params, p)
+	p, err := ConstructErr[P, T, PT](params)
+	if err != nil {
+		panic(err)
+	}
 	return p
 }
 
 // Similar to Construct() except that the return value is not a pointer.
 func ConstructVal[P any, T any, PT interface{ *T }](params P) T {
+	return *Construct[P, T, PT](params)
+}
+
+// Similar to Construct() except that defaulting and validation errors are
+// returned rather than causing a panic.
+func ConstructErr[P any, T any, PT interface{ *T }](params P) (PT, error) {
 	p := PT(new(T))
 	construct0(params, p)
-	return *p
+	err := finish(p)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Similar to ConstructErr() except that the return value is not a pointer.
+func ConstructValErr[P any, T any, PT interface{ *T }](params P) (T, error) {
+	p, err := ConstructErr[P, T, PT](params)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return *p, nil
+}
+
+// Deconstruct is the inverse of Construct(): it builds params P from the
+// fields of an existing value, following the same diutils tags. Useful in
+// tests, e.g. to feed an existing value into fx.Replace() or to compare
+// wiring:
+//
+//	params := diutils.Deconstruct[Foo, FooParams](foo)
+//	foo2 := NewFoo(params) // equal to foo
+func Deconstruct[T any, P any](v *T) P {
+	var p P
+	deconstruct0(v, &p)
+	return p
+}
+
+// Similar to Deconstruct() except that the value is not a pointer.
+func DeconstructVal[T any, P any](v T) P {
+	return Deconstruct[T, P](&v)
 }
 
 // func Construct[P any, T any, PT interface{ *T }](params interface{}) PT {
@@ -44,6 +105,56 @@ func ConstructVal[P any, T any, PT interface{ *T }](params P) T {
 // 	return p
 // }
 
+// fieldMapping is the parsed form of the diutils tag of a params field.
+type fieldMapping struct {
+	// Do not copy this field.
+	skip bool
+	// Name of the field in the constructed struct.
+	target string
+	// If not empty, target is a map and the value is stored under this key.
+	key string
+}
+
+// Parse diutils tag of the params field. Without a tag the field is copied
+// into the field with the same name.
+func parseFieldMapping(field reflect.StructField) fieldMapping {
+	m := fieldMapping{target: field.Name}
+	tag, ok := field.Tag.Lookup(TAG)
+	if !ok {
+		return m
+	}
+	tag = strings.TrimSpace(tag)
+	if tag == tagSkip {
+		m.skip = true
+		return m
+	}
+	for _, part := range strings.Split(tag, ",") {
+		k, v, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			panic(fmt.Sprintf("%s: malformed %s tag %q", field.Name, TAG, tag))
+		}
+		switch k {
+		case tagTarget:
+			m.target = v
+		case tagKey:
+			m.key = v
+		default:
+			panic(fmt.Sprintf("%s: unknown %s tag option %q", field.Name, TAG, k))
+		}
+	}
+	return m
+}
+
+// Returns a readable and settable version of the field, even if it is
+// unexported -- constructed structs commonly keep their dependencies in
+// unexported fields. The struct holding the field must be addressable.
+func accessible(field reflect.Value) reflect.Value {
+	if field.CanSet() {
+		return field
+	}
+	return reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem()
+}
+
 func construct0(params interface{}, retval interface{}) {
 	// Check if retval is a pointer
 	rv := reflect.ValueOf(retval)
@@ -74,10 +185,72 @@ func construct0(params interface{}, retval interface{}) {
 
 	// Iterate over the fields of params and copy to retval
 	for i := 0; i < rp.NumField(); i++ {
-		name := rp.Type().Field(i).Name
-		field, ok := rv.Type().FieldByName(name)
-		if ok && field.Type == rp.Field(i).Type() {
-			rv.FieldByName(name).Set(rp.Field(i))
+		m := parseFieldMapping(rp.Type().Field(i))
+		if m.skip {
+			continue
+		}
+		field, ok := rv.Type().FieldByName(m.target)
+		if !ok {
+			continue
+		}
+		value := rp.Field(i)
+		target := accessible(rv.FieldByIndex(field.Index))
+		if m.key != "" {
+			if field.Type.Kind() != reflect.Map ||
+				field.Type.Key().Kind() != reflect.String ||
+				!value.Type().AssignableTo(field.Type.Elem()) {
+				panic(fmt.Sprintf("%s: cannot store %s in %s", rp.Type().Field(i).Name, value.Type(), field.Type))
+			}
+			if target.IsNil() {
+				target.Set(reflect.MakeMap(field.Type))
+			}
+			target.SetMapIndex(reflect.ValueOf(m.key).Convert(field.Type.Key()), value)
+			continue
+		}
+		if value.Type().AssignableTo(field.Type) {
+			target.Set(value)
+		}
+	}
+}
+
+func deconstruct0(value interface{}, params interface{}) {
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		panic("value is not a pointer to a struct")
+	}
+	if rv.IsNil() {
+		panic("value is nil")
+	}
+	rv = rv.Elem()
+
+	rp := reflect.ValueOf(params).Elem()
+	if rp.Kind() != reflect.Struct {
+		panic("params is not a struct")
+	}
+
+	// Iterate over the fields of params and copy from value
+	for i := 0; i < rp.NumField(); i++ {
+		m := parseFieldMapping(rp.Type().Field(i))
+		if m.skip {
+			continue
+		}
+		field, ok := rv.Type().FieldByName(m.target)
+		if !ok {
+			continue
+		}
+		source := accessible(rv.FieldByIndex(field.Index))
+		target := accessible(rp.Field(i))
+		if m.key != "" {
+			if field.Type.Kind() != reflect.Map || field.Type.Key().Kind() != reflect.String {
+				panic(fmt.Sprintf("%s: cannot load from %s", rp.Type().Field(i).Name, field.Type))
+			}
+			source = source.MapIndex(reflect.ValueOf(m.key).Convert(field.Type.Key()))
+			if !source.IsValid() {
+				continue
+			}
+		}
+		if source.Type().AssignableTo(target.Type()) {
+			target.Set(source)
 		}
 	}
 }
@@ -0,0 +1,9 @@
+package diutils
+
+import "embed"
+
+// Sources of this package (except this file and tests), which fxforce5
+// copies into the modules it rewrites.
+//
+//go:embed *.go
+var Sources embed.FS
@@ -0,0 +1,112 @@
+package diutils
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Name of the struct tag on fields of the constructed struct holding the
+// value to use when the field is left zero after copying params, e.g.
+//
+//	Timeout time.Duration `default:"5s"`
+//
+// Only basic kinds (strings, bools, numbers) and time.Duration are supported.
+const DEFAULT_TAG = "default"
+
+// Defaulter can be implemented by constructed types to fill in defaults
+// that cannot be expressed with a default tag. SetDefaults is called after
+// the default tags have been applied.
+type Defaulter interface {
+	SetDefaults()
+}
+
+// Validator can be implemented by constructed types to check the result of
+// construction. Validate is called last; a non-nil error fails construction.
+type Validator interface {
+	Validate() error
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Runs the post-construction hooks on retval, a pointer to a struct whose
+// fields have been copied from params: default tags, Defaulter, Validator.
+func finish(retval interface{}) error {
+	err := applyDefaultTags(reflect.ValueOf(retval).Elem())
+	if err != nil {
+		return err
+	}
+	if d, ok := retval.(Defaulter); ok {
+		d.SetDefaults()
+	}
+	if v, ok := retval.(Validator); ok {
+		err = v.Validate()
+		if err != nil {
+			return fmt.Errorf("%s: %w", reflect.TypeOf(retval).Elem(), err)
+		}
+	}
+	return nil
+}
+
+func applyDefaultTags(rv reflect.Value) error {
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		def, ok := field.Tag.Lookup(DEFAULT_TAG)
+		if !ok {
+			continue
+		}
+		target := accessible(rv.Field(i))
+		if !target.IsZero() {
+			continue
+		}
+		err := setFromString(target, def)
+		if err != nil {
+			return fmt.Errorf("%s.%s: bad default %q: %w", rv.Type(), field.Name, def, err)
+		}
+	}
+	return nil
+}
+
+// Sets target, a value of basic kind, from its string representation.
+func setFromString(target reflect.Value, s string) error {
+	if target.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		target.SetInt(int64(d))
+		return nil
+	}
+	switch target.Kind() {
+	case reflect.String:
+		target.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		target.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 0, target.Type().Bits())
+		if err != nil {
+			return err
+		}
+		target.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(s, 0, target.Type().Bits())
+		if err != nil {
+			return err
+		}
+		target.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, target.Type().Bits())
+		if err != nil {
+			return err
+		}
+		target.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported kind %s", target.Kind())
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package diutils
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Out populates R, a struct embedding fx.Out, from values: the fields of R
+// other than the embedded fx.Out are assigned the values in order. Designed
+// to take the results of a constructor directly:
+//
+//	type ClientResult struct {
+//		fx.Out
+//		Client        *Client
+//		HealthChecker *HealthChecker
+//	}
+//
+//	func NewClient(cfg Config) ClientResult {
+//		return diutils.Out[ClientResult](NewClientOrig(cfg))
+//	}
+func Out[R any](values ...any) R {
+	var r R
+	populateOut(&r, values)
+	return r
+}
+
+// Similar to Out() except that the last value is an error, as returned by
+// constructors of the form func(...) (A, B, error). If it is not nil, it is
+// returned along with a zero R.
+func OutErr[R any](values ...any) (R, error) {
+	var r R
+	if len(values) == 0 {
+		panic("OutErr needs at least an error value")
+	}
+	last := values[len(values)-1]
+	if last != nil {
+		err, ok := last.(error)
+		if !ok {
+			panic(fmt.Sprintf("last value is %T, not an error", last))
+		}
+		return r, err
+	}
+	populateOut(&r, values[:len(values)-1])
+	return r, nil
+}
+
+func populateOut(out interface{}, values []any) {
+	rv := reflect.ValueOf(out).Elem()
+	if rv.Kind() != reflect.Struct {
+		panic("result is not a struct")
+	}
+	i := 0
+	for f := 0; f < rv.NumField(); f++ {
+		field := rv.Type().Field(f)
+		// Embedded fx.Out
+		if field.Anonymous {
+			continue
+		}
+		if i >= len(values) {
+			panic(fmt.Sprintf("%s: not enough values, %d given", rv.Type(), len(values)))
+		}
+		if values[i] != nil {
+			value := reflect.ValueOf(values[i])
+			if !value.Type().AssignableTo(field.Type) {
+				panic(fmt.Sprintf("%s.%s: cannot assign %s", rv.Type(), field.Name, value.Type()))
+			}
+			accessible(rv.Field(f)).Set(value)
+		}
+		i++
+	}
+	if i != len(values) {
+		panic(fmt.Sprintf("%s: too many values, %d given", rv.Type(), len(values)))
+	}
+}
@@ -1,17 +1,18 @@
 package fxforce5
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"go/types"
+	"log/slog"
+	"sort"
+	"strconv"
 	"strings"
 
-	"github.com/rs/zerolog/log"
-
 	"github.com/dave/dst"
 	"github.com/dave/dst/decorator"
 	"github.com/dave/dst/dstutil"
-	"golang.org/x/mod/modfile"
 	"golang.org/x/tools/go/packages"
 
 	// TODO make even this dynamic
@@ -26,6 +27,9 @@ import (
 	//	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sync"
 )
 
 const (
@@ -33,37 +37,106 @@ const (
 	DIUTILS_IMPORT = "\"github.com/debedb/fxforce5/diutils\""
 
 	// Whether to import diutils module as local to the
-	// analyzed project (true) or from DIUTILS_IMPORT (false)
-	// TODO should be configurable on CLI -- but the import from
-	// this package would require modifying go.mod of the target.
+	// analyzed project (true) or from DIUTILS_IMPORT (false), unless a
+	// version of the fxforce5 module is given, see WithDiutilsVersion().
 	DIUTILS_LOCAL = true
 
 	// Processed directive to ignore a file
 	PROCESSED_DIRECTIVE = "// +fxforce5:processed"
+
+	// Struct tag understood by diutils.Construct(), see diutils.TAG.
+	DIUTILS_TAG = "diutils"
 )
 
 // Analyzer uses various reflection/introspection/code analysis methods to analyze
 // code and store metadata about it, for various purposes. It works on a level of
 // a Go "repository" (see https://golang.org/doc/code.html#Organization).
 type Analyzer struct {
-	// Path started with.
+	// Path started with: a directory, or a package pattern ending with
+	// "/...".
 	path string
 
-	// List of files to ignore.
-	ignores []string
-
-	// In Go convention, this is "src" directory under path (above). Saved
-	// here to avoid doing path + "/src" all the time.s
-	srcDir string
-
-	// Module path parsed from go.mod file.
-	modPath string
-
-	// List of paths that have already been analyzed
+	// Globs of files and directories to exclude, and of files to include
+	// (all if none), see selection.go.
+	ignores  []string
+	includes []string
+	// Whether .gitignore files are honoured, and their rules.
+	gitignore      bool
+	gitignoreRules []gitignoreRule
+	// Patterns of the packages to rewrite (all if none), and the same as
+	// regular expressions matching import paths.
+	pkgPatterns []string
+	pkgRegexps  []*regexp.Regexp
+
+	// Absolute path of the directory to rewrite the files under, path
+	// without "/...".
+	dir string
+	// Modules to analyze, innermost first, see findModules().
+	modules []*goModule
+
+	// Versions of go.uber.org/fx and of the fxforce5 module (if diutils
+	// is not local) required in go.mod, see updateGoMods().
+	fxVersion      string
+	diutilsVersion string
+	// Directory, relative to the module root, of the local diutils package,
+	// see materializeDiutils().
+	diutilsDir string
+
+	// Go files to analyze, in the order of the walk, and the same as a set.
 	analyzed []string
+	visited  map[string]bool
+	// Number of packages analyzed concurrently, see WithJobs().
+	jobs int
+	// Whether files are still rewritten once errors are found, see
+	// diagnostics.go.
+	keepGoing bool
+	// Logger of the run, see logging.go.
+	logger *slog.Logger
+	// Transformations applied, all if nil, see WithTransformations().
+	transformations map[Transformation]bool
+	// Files written keyed by path, when they are written to memory rather
+	// than to disk, see output.go.
+	outputs      map[string][]byte
+	outputsMutex sync.Mutex
+	// Whether the analyzer ran, see start().
+	started bool
+	// Directory of the cache of the results of the analysis of packages,
+	// "" for none, see cache.go.
+	cacheDir string
+	// Reports of the packages keyed by directory, see report.go.
+	reports map[string]*PackageReport
 	// All the import paths that we have gone through.
 	importPaths []string
 
+	// Rules putting providers into value groups.
+	groupRules []GroupRule
+
+	// What is done with test files, and the test files found, see
+	// updateTestFiles().
+	testPolicy TestFilePolicy
+	testFiles  []string
+	// Build tags the packages are loaded with, see skipReason().
+	buildTags []string
+	// Rewritten constructors keyed by package path and original name, see
+	// updateTestFile().
+	rewrittenCtors map[string]bool
+
+	// Patterns that names of constructors must match.
+	ctorPatterns []*regexp.Regexp
+	// The constructor chosen for each type, keyed by package path and type
+	// name, see findConstructors().
+	ctorChoice map[string]ctorChoice
+
+	// Names invented for duplicate-typed fields, see NamedDependency.
+	namedDeps map[string]*namedDep
+	// Fields that are optional dependencies, keyed like namedDeps.
+	optionalFields map[string]bool
+
+	// Type-checked packages of the module, and the same keyed by the
+	// absolute paths of their files.
+	packages  []*packages.Package
+	pkgByFile map[string]*packages.Package
+
 	buildPackages []build.Package
 	astPackages   []ast.Package
 	docPackages   []doc.Package
@@ -76,94 +149,204 @@ type Analyzer struct {
 }
 
 // NewAnalyzer creates a new Analyzer object for analysis of Go project
-// in the provided path.
-func NewAnalyzer(path string, ignores []string) *Analyzer {
-	// Hm do we need conf?
-	conf := packages.Config{Mode: packages.NeedName | packages.NeedFiles | packages.NeedDeps | packages.NeedSyntax | packages.NeedTypesInfo | packages.NeedModule,
+// in the provided path. Files and directories matching the ignores globs
+// are not rewritten, see WithExclude().
+func NewAnalyzer(path string, ignores []string, opts ...Option) *Analyzer {
+	conf := packages.Config{Mode: packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports | packages.NeedDeps |
+		packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo | packages.NeedModule,
 		Dir: path}
 	a := &Analyzer{
-		path:     path,
-		srcDir:   path + "/src",
-		analyzed: make([]string, 0),
-		conf:     &conf,
+		path:       path,
+		ignores:    append([]string{}, ignores...),
+		analyzed:   make([]string, 0),
+		testPolicy: TEST_FILES_SKIP,
+		jobs:       runtime.GOMAXPROCS(0),
+		cacheDir:   DefaultCacheDir(),
+		logger:     slog.Default(),
+		fxVersion:  DEFAULT_FX_VERSION,
+		diutilsDir: DEFAULT_DIUTILS_DIR,
+		conf:       &conf,
 		// fullTypeDocs:  common.MkMapStr(),
 		// shortTypeDocs: common.MkMapStr(),
 		fileSet: token.NewFileSet(),
 	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if len(a.buildTags) > 0 {
+		conf.BuildFlags = []string{"-tags=" + strings.Join(a.buildTags, ",")}
+	}
 	return a
 }
 
-func (a *Analyzer) Analyze() error {
-	f, err := os.Open(a.srcDir)
+// Analyze rewrites the files under the path, and returns the report of
+// what it found and did. The report is returned even if the run fails, as
+// far as it went. An error is returned as well if files had errors, see
+// WithKeepGoing().
+func (a *Analyzer) Analyze() (*Report, error) {
+	err := a.start()
+	if err != nil {
+		return nil, err
+	}
+	err = a.analyze()
+	if err == nil {
+		if n := a.errorCount(); n > 0 {
+			err = fmt.Errorf("%d errors", n)
+		}
+	}
+	return a.report(), err
+}
+
+func (a *Analyzer) analyze() error {
+	err := a.prepare()
+	if err != nil {
+		return err
+	}
+	err = a.stopAtErrors()
+	if err != nil {
+		return err
+	}
+	err = a.analyzeFiles()
+	if err != nil {
+		return err
+	}
+
+	err = a.updateTestFiles()
+	if err != nil {
+		return err
+	}
+
+	err = a.materializeDiutils()
+	if err != nil {
+		return err
+	}
+	err = a.updateGoMods()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Load the packages and find the files to analyze. The errors found are in
+// the reports, see stopAtErrors().
+func (a *Analyzer) prepare() error {
+	// "./..." as for the go command, which is the same as "."
+	dir := a.path
+	if dir == "..." || strings.HasSuffix(dir, "/...") {
+		dir = strings.TrimSuffix(dir, "...")
+	}
+	dir, err := filepath.Abs(dir)
 	if err != nil {
 		return err
 	}
-	info, err := f.Stat()
+	info, err := os.Stat(dir)
 	if err != nil {
 		return err
 	}
-	err = f.Close()
 	if !info.IsDir() {
-		return errors.New(fmt.Sprintf("Expected %s to be a directory", a.srcDir))
+		return errors.New(fmt.Sprintf("Expected %s to be a directory", dir))
 	}
+	a.dir = dir
 
-	goModFile := a.srcDir + "/go.mod"
-	goModBuf, err := os.ReadFile(goModFile)
+	err = a.findModules()
 	if err != nil {
 		return err
 	}
-	modFile, err := modfile.Parse(goModFile, goModBuf, nil)
+
+	err = a.prepareSelection()
 	if err != nil {
 		return err
 	}
-	a.modPath = modFile.Module.Mod.Path
 
-	err = filepath.Walk(a.srcDir, a.walker)
+	err = a.loadPackages()
 	if err != nil {
 		return err
 	}
-	log.Printf("Visited:\n%s", a.analyzed)
+	a.findConstructors()
+	a.findNamedDependencies()
+	a.findOptionalFields()
 
+	a.visited = make(map[string]bool)
+	err = filepath.Walk(a.dir, a.walker)
+	if err != nil {
+		return err
+	}
+	a.infof("Found %d files to analyze", len(a.analyzed))
 	return nil
 }
 
 func (a *Analyzer) walker(path string, info os.FileInfo, err error) error {
-	if path == a.srcDir {
+	if path == a.dir {
 		return nil
 	}
+	if err == nil && info.IsDir() && a.isForeignModule(path) {
+		a.infof("Ignoring %s -- module not analyzed", path)
+		return filepath.SkipDir
+	}
 	name := info.Name()
 	//	log.Printf("Entered walker(\"%s\", \"%s\", %+v)", path, name, err)
 	firstChar := string(name[0])
 	isDotFile := firstChar == "."
 	//	log.Printf("Checking %v vs .: %v", firstChar, isDotFile)
 	if isDotFile {
-		log.Printf("Ignoring (dotfile): %s", name)
+		a.debugf("Ignoring (dotfile): %s", name)
 		if info.IsDir() {
 			return filepath.SkipDir
 		}
 		return nil
 	}
 
-	if In(path, a.analyzed) {
-		log.Printf("Ignoring (visited): %s in %+v", path, a.analyzed)
+	if a.visited[path] {
+		a.debugf("Ignoring (visited): %s", path)
 		return nil
 	}
 	if err != nil {
-		log.Error().Msgf("Error in walking %s: %s", path, err)
+		a.errorf("Error in walking %s: %s", path, err)
 		return err
 	}
 
 	if name == "vendor" || name == "generated" {
-		log.Printf("Ignoring path %s", path)
+		a.debugf("Ignoring path %s", path)
 		return filepath.SkipDir
 	}
 
+	if info.IsDir() {
+		reason, err := a.dirSelectReason(path)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			a.skipPath(path, true, reason)
+			return filepath.SkipDir
+		}
+	}
+
 	if strings.HasSuffix(name, ".go") {
-		err = a.analyzeFile(path)
+		// Written by a previous run, see rewrittenOverlay().
+		if isRewrittenFile(name) {
+			a.debugf("Ignoring (rewritten): %s", path)
+			return nil
+		}
+		if reason := a.fileSelectReason(path); reason != "" {
+			a.skipPath(path, false, reason)
+			return nil
+		}
+		reason, err := a.skipReason(path)
 		if err != nil {
-			log.Error().Msgf("Error in analyzing %s: %s", path, err)
+			a.fileError(path, err)
+			return nil
 		}
-		// Really don't need this
+		if reason != "" {
+			a.skipPath(path, false, reason)
+			return nil
+		}
+		if strings.HasSuffix(name, "_test.go") {
+			a.testFiles = append(a.testFiles, path)
+			return nil
+		}
+		// Analyzed once the walk is over, see analyzeFiles().
+		a.visited[path] = true
 		a.analyzed = append(a.analyzed, path)
 	}
 
@@ -171,12 +354,22 @@ func (a *Analyzer) walker(path string, info os.FileInfo, err error) error {
 }
 
 type analyzedFile struct {
+	analyzer *Analyzer
+	// Module of the file.
+	module *goModule
+
 	path    string
 	relPath string
+	// Import path of the package of the file, known even without type
+	// information.
+	pkgPath string
 
 	diutilsImportPath string
 
 	dstFile *dst.File
+	// Decorator the file was parsed with, mapping its nodes to their
+	// positions, see errorAt().
+	decorator *decorator.Decorator
 
 	// Constructed in inspect()
 	structTypes []*dst.TypeSpec
@@ -190,8 +383,43 @@ type analyzedFile struct {
 	// Constructed in prepareParamStructs()
 	paramStruct map[string]*dst.TypeSpec
 
-	hasUberFxImport  bool
-	hasDiUtilsImport bool
+	// Type-checked package of the file, or nil if type information is not
+	// available.
+	pkg *packages.Package
+	// What was left alone in the file, see skip(), and the warnings about
+	// it.
+	skips       []SkipReport
+	diagnostics []Diagnostic
+
+	// Import paths of the file mapped to the names they are imported as.
+	imports map[string]string
+	// Imports to add to the file, see addImports().
+	newImports []newImport
+	// Names the fx and diutils packages are referred to by in the file,
+	// see resolveImportNames().
+	fxName      string
+	diutilsName string
+
+	// Package vars holding factories, provided with fx.Supply(), see
+	// inspectFactoryVar().
+	suppliedVars []string
+
+	// Slices of grouped interfaces, see applyGroupRules().
+	groupSlices []groupSlice
+
+	// Constructors found in pass 1 keyed like ctors, before choosing one
+	// per type, see chooseCtors().
+	ctorCandidates map[string][]*ctorInfo
+
+	// Original names of the constructors rewritten in pass 2.
+	renamedCtors []string
+	// Whether the rewritten file was written.
+	written bool
+
+	// Set by the ignore-file directive.
+	ignored bool
+	// Structs marked with the skip directive.
+	skippedStructs map[string]bool
 
 	existingModuleVar string
 
@@ -206,67 +434,60 @@ func (af *analyzedFile) pass2Apply(c *dstutil.Cursor) bool {
 	n := c.Node()
 	switch nType := n.(type) {
 
-	case *dst.ImportSpec:
-		if !af.hasUberFxImport {
-			c.InsertBefore(&dst.ImportSpec{Path: &dst.BasicLit{Value: UBER_FX_IMPORT}})
-			af.hasUberFxImport = true
-		}
-		if !af.hasDiUtilsImport {
-			c.InsertBefore(&dst.ImportSpec{Path: &dst.BasicLit{
-				Value: "\"" + af.diutilsImportPath + "\""}})
-			af.hasDiUtilsImport = true
-		}
-
 	case *dst.File:
 
 		// Set PROCESSED_DIRECTIVE for next time
 		nType.Decs.Start.Prepend(PROCESSED_DIRECTIVE)
 
-	case *dst.ValueSpec:
-		fmt.Print("ValueSpec: ")
-
 	case *dst.FuncDecl:
 		// Replace constructor now
-		if strings.HasPrefix(nType.Name.Name, "New") {
+		// Returning false would stop the traversal altogether, so skipped
+		// constructors return true.
+		if ctorInfo := af.ctorOf(nType); ctorInfo != nil {
 			ctorName := nType.Name.Name
-			ctorType := strings.TrimPrefix(ctorName, "New")
-			log.Printf("Found constructor: %+v", ctorName)
-			ctorInfo := af.ctors[ctorType]
-			if ctorInfo == nil {
-				log.Printf("Skipping %s -- not in list of constructors", ctorName)
-				return false
+			af.analyzer.debugf("Found constructor: %+v", ctorName)
+			if nType.Recv != nil {
+				c.InsertAfter(af.getMethodProvider(ctorInfo))
+				return true
 			}
-			if ctorInfo.returnInfo.returnKind == interfaceKind {
-				log.Printf("Skipping %s -- it's an interface constructor", ctorName)
-				return false
+			if !ctorInfo.rewritten() {
+				af.analyzer.debugf("Skipping %s -- it does not construct a local struct", ctorName)
+				return true
 			}
 
 			// Rename original one
 
 			nType.Name.Name = ctorName + "Orig"
+			af.renamedCtors = append(af.renamedCtors, ctorName)
+			ctorInfo.renamed = true
+			ctorInfo.origName = ctorName
 			c.Replace(nType)
 
-			// Only one result here; otherwise would be an error on preprocessing.
+			if ctorInfo.returnInfo.returnKind == multiKind {
+				af.rewriteMultiCtor(c, ctorName, ctorInfo)
+				return true
+			}
+
+			// Only one result (possibly followed by an error) here; otherwise
+			// would be an error on preprocessing.
 			results := nType.Type.Results.List
 			result := results[0]
 
 			// TODO we could have already saved it from the original parse
 			// Plus we'll need to make distinction between pointer and non-pointer
 
-			var origStructName string
-			var valReturnType bool
-			switch result.Type.(type) {
-			case *dst.StarExpr:
-				origStructName = result.Type.(*dst.StarExpr).X.(*dst.Ident).Name
+			valReturnType := true
+			typeExpr := result.Type
+			if star, ok := typeExpr.(*dst.StarExpr); ok {
+				typeExpr = star.X
 				valReturnType = false
-			case *dst.Ident:
-				origStructName = result.Type.(*dst.Ident).Name
-				valReturnType = true
-			default:
-				errMsg := fmt.Sprintf("%s: Constructor %s has unexpected result type: %+v", af.relPath, nType.Name.Name, result.Type)
-				af.err = errors.New(errMsg)
+			}
+			ident, ok := typeExpr.(*dst.Ident)
+			if !ok {
+				af.err = af.errorAt(result.Type, DIAG_RESULT_TYPE, "constructor %s has unexpected result type %T", ctorName, typeExpr)
 				return false
 			}
+			origStructName := ident.Name
 
 			paramStructName := origStructName + "Params"
 
@@ -277,19 +498,23 @@ func (af *analyzedFile) pass2Apply(c *dstutil.Cursor) bool {
 			// return diutils.Construct[ServerParams, ServerCfg](p)
 			constructCall := &dst.CallExpr{}
 			constructGenericParams := []dst.Expr{
-				&dst.Ident{Name: origStructName},
 				&dst.Ident{Name: paramStructName},
+				&dst.Ident{Name: origStructName},
 			}
 
+			ctorInfo.constructErr = ctorInfo.returnsErr || af.constructCanFail(origStructName)
 			diutilsFuncName := "Construct"
 			if valReturnType {
 				diutilsFuncName += "Val"
 			}
+			if ctorInfo.constructErr {
+				diutilsFuncName += "Err"
+			}
 
 			constructCall.Fun = &dst.IndexListExpr{
 				// diutils.Construct
 				X: &dst.SelectorExpr{
-					X:   &dst.Ident{Name: "diutils"},
+					X:   &dst.Ident{Name: af.diutilsName},
 					Sel: &dst.Ident{Name: diutilsFuncName},
 				},
 				// Generic type parameters
@@ -301,6 +526,9 @@ func (af *analyzedFile) pass2Apply(c *dstutil.Cursor) bool {
 			body := &dst.BlockStmt{
 				List: []dst.Stmt{retStmt},
 			}
+			if ctorInfo.lifecycle != nil {
+				body = af.getLifecycleBody(constructCall, ctorInfo)
+			}
 
 			var ctorResults *dst.FieldList
 			if valReturnType {
@@ -315,6 +543,9 @@ func (af *analyzedFile) pass2Apply(c *dstutil.Cursor) bool {
 					},
 				}
 			}
+			if ctorInfo.constructErr {
+				ctorResults.List = append(ctorResults.List, &dst.Field{Type: &dst.Ident{Name: "error"}})
+			}
 
 			newCtor := &dst.FuncDecl{
 				Name: &dst.Ident{Name: ctorName},
@@ -328,36 +559,20 @@ func (af *analyzedFile) pass2Apply(c *dstutil.Cursor) bool {
 			c.InsertBefore(newCtor)
 		}
 
-	case *dst.GenDecl:
-		// Add fx.Module declaration if needed, after imports
-		if nType.Tok == token.IMPORT {
-			if af.existingModuleVar != "" {
-				log.Printf("Skipping adding fx.Module declaration to %s -- already exists as %+v\n", af.relPath, af.existingModuleVar)
-				break
-			}
-			decl := af.getFxModuleDecl()
-			dstDecl, err := decorator.NewDecorator(nil).DecorateNode(decl)
-			if err != nil {
-				af.err = err
-				return false
-			}
-			c.InsertAfter(dstDecl)
-		}
-
 	// Add params struct
 	case *dst.TypeSpec:
 		if _, ok := nType.Type.(*dst.StructType); !ok {
 			// TODO:
-			log.Printf("Skipping %s -- not a struct\n", nType.Name.Name)
+			af.analyzer.debugf("Skipping %s -- not a struct", nType.Name.Name)
 			break
 		}
 		origStructName := nType.Name.Name
 		paramStructDecl := af.paramStruct[origStructName]
 		if paramStructDecl == nil {
-			log.Printf("No param struct for %s\n", origStructName)
+			af.analyzer.debugf("No param struct for %s", origStructName)
 			break
 		}
-		log.Printf("Inserting %s after %s\n", paramStructDecl.Name.Name, nType.Name.Name)
+		af.analyzer.debugf("Inserting %s after %s", paramStructDecl.Name.Name, nType.Name.Name)
 
 		c.InsertAfter(paramStructDecl)
 	}
@@ -370,6 +585,10 @@ type returnKind int
 const (
 	structKind returnKind = iota + 1
 	interfaceKind
+	// Several results, provided via an fx.Out struct.
+	multiKind
+	// Anything else, e.g. types from other packages.
+	externalKind
 )
 
 type returnInfo struct {
@@ -381,106 +600,220 @@ type returnInfo struct {
 
 type ctorInfo struct {
 	returnInfo *returnInfo
-	decl       *dst.FuncDecl
+	// Declaration of the constructor function or method, nil for function
+	// values.
+	decl *dst.FuncDecl
+	// Name of what is passed to fx.Provide() when it is not the constructor
+	// function itself: the var holding the function value, or the function
+	// generated for a constructor method.
+	provider string
+	// Whether the constructor returns an error as its last result, in
+	// which case the generated one does too.
+	returnsErr bool
+	// Whether the generated constructor returns an error: the original one
+	// does, or constructing the result can fail, see constructCanFail().
+	constructErr bool
+	// For multiKind, the types of the results (not including the error).
+	results []dst.Expr
+	// Whether the declaration was renamed NewXOrig in pass 2, and its name
+	// before, which the generated constructor takes.
+	renamed  bool
+	origName string
+
+	// Value group the result is provided into, see GroupRule.
+	group string
+	// Name the result is provided under, see NamedDependency.
+	name string
+	// Lifecycle methods of the result, if any.
+	lifecycle *lifecycleHooks
+	// Types (as expressions in the file) the result is provided as, with
+	// fx.As().
+	as []string
 }
 
 // Get information about return object of a constructor.
-// Returns name of the return type and whether it's a value or pointer.
+// Returns name of the return type, whether it's a value or pointer and
+// whether it's a local struct or interface.
 func (af *analyzedFile) getReturnInfo(expr dst.Expr) *returnInfo {
-	retInfo := &returnInfo{ptr: false}
+	retInfo := &returnInfo{ptr: false, returnKind: externalKind}
 
-	switch e := expr.(type) {
-	case *dst.StarExpr:
+	typeExpr := expr
+	if star, ok := expr.(*dst.StarExpr); ok {
 		retInfo.ptr = true
-		retInfo.name = e.X.(*dst.Ident).Name
-		log.Printf("%s\n", e.X.(*dst.Ident).Obj.Kind)
-		retInfo.returnKind = structKind
-		// TODO handle ptr to ifc
-	case *dst.Ident:
-		retInfo.name = e.Name
-		resKindDecl := e.Obj.Decl
-
-		// We want to see the kind of the result type: interface or struct
-		// We're ignoring all other types for now.
-		switch spec := resKindDecl.(type) {
-		case *dst.TypeSpec:
-			resTypeType := spec.Type
-			switch resTypeType.(type) {
-			case *dst.InterfaceType:
+		typeExpr = star.X
+	}
+	ident, ok := typeExpr.(*dst.Ident)
+	if !ok || ident.Path != "" {
+		// Qualified, generic and composite types are not local.
+		return retInfo
+	}
+	retInfo.name = ident.Name
+
+	// We want to see the kind of the result type: interface or struct
+	// We're ignoring all other types for now.
+	if named := af.localNamed(ident.Name); named != nil {
+		switch named.Underlying().(type) {
+		case *types.Struct:
+			retInfo.returnKind = structKind
+		case *types.Interface:
+			if !retInfo.ptr {
 				retInfo.returnKind = interfaceKind
-			case *dst.StructType:
-				retInfo.returnKind = structKind
-			default:
-				errMsg := fmt.Sprintf("Unexpected type for result type: %+v", resTypeType)
-				panic(errMsg)
 			}
-		default:
-			// TODO
-			errMsg := fmt.Sprintf("%s: Constructor %s has unexpected result type: %+v", af.relPath, nType.Name.Name, resType)
-			panic(errMsg)
 		}
+		return retInfo
+	}
 
-	default:
-		errMsg := fmt.Sprintf("%s: Constructor %s has unexpected result type: %+v", af.relPath, nType.Name.Name, resType)
-		// TODO
-		panic(errMsg)
+	// Without type information, only the types declared in this file are
+	// known.
+	if ident.Obj == nil {
+		return retInfo
+	}
+	if spec, ok := ident.Obj.Decl.(*dst.TypeSpec); ok {
+		switch spec.Type.(type) {
+		case *dst.InterfaceType:
+			if !retInfo.ptr {
+				retInfo.returnKind = interfaceKind
+			}
+		case *dst.StructType:
+			retInfo.returnKind = structKind
+		}
 	}
+	return retInfo
 }
 
 func (af *analyzedFile) inspectConstructor(nType *dst.FuncDecl) bool {
-	if af.ctors == nil {
-		af.ctors = make(map[string]*ctorInfo)
-	}
-	ctorInfo := &ctorInfo{decl: nType}
-	// TODO this is too big, refactor
-	if strings.HasPrefix(nType.Name.Name, "New") {
-		log.Printf("Found constructor: %+v", nType.Name.Name)
-		results := nType.Type.Results
-		if results.NumFields() != 1 {
-			errMsg := fmt.Sprintf("%s: Constructor %s has %d results, expected 1", af.relPath, nType.Name.Name, results.NumFields())
-			af.err = errors.New(errMsg)
-			return false
+	if nType.Recv != nil {
+		af.inspectMethodCtor(nType)
+		return true
+	}
+	if !dst.IsExported(nType.Name.Name) || !af.analyzer.isCtorName(nType.Name.Name) {
+		return true
+	}
+	d := af.parseDirectives(nType.Decs.Start)
+	if d.has(skipDirective) {
+		af.skip(nType.Name.Name, "marked "+DIRECTIVE_PREFIX+skipDirective)
+		return true
+	}
+	if nType.Type.TypeParams != nil {
+		af.inspectGenericCtor(nType, d)
+		return true
+	}
+	ctor := af.newCtorInfo(nType.Name.Name, nType.Type)
+	if ctor == nil {
+		return true
+	}
+	ctor.decl = nType
+	af.applyCtorDirectives(ctor, d)
+	af.addCtorCandidate(ctor)
+	return true
+}
+
+// Get information about a constructor (function, method or function value)
+// of the given type from its results. Returns nil if it has no results.
+func (af *analyzedFile) newCtorInfo(name string, funcType *dst.FuncType) *ctorInfo {
+	resultTypes := flattenFields(funcType.Results)
+	returnsErr := len(resultTypes) > 1 && isErrorType(resultTypes[len(resultTypes)-1])
+	if returnsErr {
+		resultTypes = resultTypes[:len(resultTypes)-1]
+	}
+	if len(resultTypes) == 0 {
+		af.skip(name, "it has no results")
+		return nil
+	}
+
+	var returnInfo *returnInfo
+	if len(resultTypes) == 1 {
+		resType := resultTypes[0]
+		af.analyzer.debugf("Result type: %+v", resType)
+		returnInfo = af.getReturnInfo(resType)
+	} else {
+		af.analyzer.debugf("Result types: %+v", resultTypes)
+		if dup := af.duplicateResult(resultTypes); dup != nil {
+			af.warnAt(dup, DIAG_RESULT_TYPE, "%s returns the same type more than once, which fx cannot provide", name)
+			af.skip(name, "it returns the same type more than once")
+			return nil
 		}
-		resType := results.List[0].Type
-		log.Printf("Result type: %+v", resType)
+		returnInfo = af.getMultiReturnInfo(name, resultTypes)
+	}
+	af.analyzer.debugf("Found constructor: %+v", name)
 
-		// Identifier of the result type (name of struct or interface)
-		// Not to be confused with kind (WHETHER it is a a struct or interface)
-		// TODO: is it even correct terminology?
-		var resTypeKey string
+	ctor := &ctorInfo{returnInfo: returnInfo, returnsErr: returnsErr}
+	if returnInfo.returnKind == multiKind {
+		ctor.results = resultTypes
+	}
+	return ctor
+}
 
-		returnInfo := af.getReturnInfo(resType)
+// Add the constructor to the candidates of the file, see chooseCtors().
+func (af *analyzedFile) addCtorCandidate(ctor *ctorInfo) {
+	// Identifier of the result type (name of struct or interface)
+	// Not to be confused with kind (WHETHER it is a a struct or interface)
+	// Constructors that are not rewritten are keyed by their own name, as
+	// there can be any number of them for the same type.
+	resTypeKey := ctor.returnInfo.name
+	if !ctor.rewritten() {
+		resTypeKey = ctor.providerName()
+	}
+	if af.ctorCandidates == nil {
+		af.ctorCandidates = make(map[string][]*ctorInfo)
+	}
+	af.ctorCandidates[resTypeKey] = append(af.ctorCandidates[resTypeKey], ctor)
+}
 
-		if returnInfo.returnKind == structKind {
-			if af.constructors == nil {
-				af.constructors = make(map[string]*dst.FuncDecl)
-			}
-			if af.constructors[resTypeKey] != nil {
-				errMsg := fmt.Sprintf("%s: Constructor for %s already exists: %+v", af.relPath, resTypeKey, af.constructors[resTypeKey])
-				af.err = errors.New(errMsg)
-				return false
-			}
-			af.constructors[resTypeKey] = nType
-			for i, param := range nType.Type.Params.List {
-				log.Printf("\tParam %d: %+v", i, param)
-			}
-		} else {
-			if af.ifcConstructors == nil {
-				af.ifcConstructors = make(map[string]*dst.FuncDecl)
-			}
+// Returns true if the constructor is replaced by one taking a params struct
+// (or, for several results, returning an fx.Out struct).
+func (ctor *ctorInfo) rewritten() bool {
+	if ctor.provider != "" {
+		return false
+	}
+	kind := ctor.returnInfo.returnKind
+	return kind == structKind || kind == multiKind
+}
 
-			if af.ifcConstructors[resTypeKey] != nil {
-				errMsg := fmt.Sprintf("%s: Constructor for %s already exists: %+v", af.relPath, resTypeKey, af.ifcConstructors[resTypeKey])
-				af.err = errors.New(errMsg)
-				return false
-			}
-			af.ifcConstructors[resTypeKey] = nType
-			for i, param := range nType.Type.Params.List {
-				log.Printf("\tParam %d: %+v", i, param)
-			}
+// Returns the constructor declared by the declaration, or nil.
+func (af *analyzedFile) ctorOf(decl *dst.FuncDecl) *ctorInfo {
+	for _, ctor := range af.ctors {
+		if ctor.decl == decl {
+			return ctor
 		}
 	}
-	return true
+	return nil
+}
+
+// Returns the constructor of the struct type with the given name, or nil if
+// there is none. Interface constructors are not returned.
+func (af *analyzedFile) structCtor(name string) *ctorInfo {
+	ctor := af.ctors[name]
+	if ctor == nil || ctor.returnInfo.returnKind != structKind || !ctor.rewritten() {
+		return nil
+	}
+	return ctor
+}
+
+// Returns the keys of all constructors, sorted so that the generated code
+// does not depend on map iteration order.
+func (af *analyzedFile) ctorKeys() []string {
+	keys := make([]string, 0, len(af.ctors))
+	for key := range af.ctors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Returns the keys of all constructors that are provided in the fx.Module of
+// the file, sorted. Constructors that are not rewritten are only provided
+// when they are annotated, e.g. to feed a value group, or when they are not
+// plain functions, see factories.go.
+func (af *analyzedFile) providerNames() []string {
+	names := make([]string, 0, len(af.ctors))
+	for _, name := range af.ctorKeys() {
+		ctor := af.ctors[name]
+		if ctor.rewritten() || ctor.provider != "" || ctor.group != "" || ctor.name != "" || len(ctor.as) > 0 {
+			names = append(names, name)
+		}
+	}
+	return names
 }
 
 // First pass -- analyze the file and collect information about it.
@@ -491,21 +824,34 @@ func (af *analyzedFile) pass1Inspect(c *dstutil.Cursor) bool {
 	switch nType := n.(type) {
 
 	case *dst.ImportSpec:
-		if nType.Path.Value == UBER_FX_IMPORT {
-			af.hasUberFxImport = true
+		path, err := strconv.Unquote(nType.Path.Value)
+		if err != nil {
+			af.err = af.errorAt(nType, DIAG_SYNTAX, "malformed import path %s", nType.Path.Value)
+			return false
 		}
-		if nType.Path.Value == af.diutilsImportPath {
-			af.hasDiUtilsImport = true
+		if af.imports == nil {
+			af.imports = make(map[string]string)
+		}
+		af.imports[path] = af.importedName(nType, path)
+
+	case *dst.File:
+		if af.parseDirectives(nType.Decs.Start).has(ignoreFileDirective) {
+			af.skip("", "marked "+DIRECTIVE_PREFIX+ignoreFileDirective)
+			af.ignored = true
 		}
 
 	case *dst.TypeSpec:
+		if af.parseDirectives(nType.Decs.Start).has(skipDirective) {
+			af.skipStruct(nType.Name.Name)
+			return true
+		}
 		switch nType.Type.(type) {
 		case *dst.InterfaceType:
 			// Ignore for now https://github.com/debedb/fxforce5/issues/5
-			log.Printf("Found interface: %+v, ignoring for now", nType.Name.Name)
+			af.analyzer.debugf("Found interface: %+v, ignoring for now", nType.Name.Name)
 			// af.structTypes = append(af.structTypes, nType)
 		case *dst.StructType:
-			log.Printf("Found struct: %+v", nType.Name.Name)
+			af.analyzer.debugf("Found struct: %+v", nType.Name.Name)
 			af.structTypes = append(af.structTypes, nType)
 
 		}
@@ -515,11 +861,24 @@ func (af *analyzedFile) pass1Inspect(c *dstutil.Cursor) bool {
 		return ok
 
 	case *dst.GenDecl:
+		// The doc comment of "type X struct" belongs to the declaration
+		// rather than to the spec.
+		if nType.Tok == token.TYPE && af.parseDirectives(nType.Decs.Start).has(skipDirective) {
+			for _, spec := range nType.Specs {
+				af.skipStruct(spec.(*dst.TypeSpec).Name.Name)
+			}
+			return true
+		}
 		// Look for var declarations having fx.Module -- to skip calling
 		// addFxModule if so
 		if nType.Tok != token.VAR {
 			return true
 		}
+		if _, ok := c.Parent().(*dst.File); ok {
+			for _, spec := range nType.Specs {
+				af.inspectFactoryVar(nType, spec.(*dst.ValueSpec))
+			}
+		}
 		// This is a lot of nested ifs, sigh.
 		for _, spec := range nType.Specs {
 			if valSpec, ok := spec.(*dst.ValueSpec); ok {
@@ -527,7 +886,7 @@ func (af *analyzedFile) pass1Inspect(c *dstutil.Cursor) bool {
 					if callExpr, ok := expr.(*dst.CallExpr); ok {
 						if selExpr, ok := callExpr.Fun.(*dst.SelectorExpr); ok {
 							if xExpr, ok := selExpr.X.(*dst.Ident); ok {
-								if xExpr.Name == "fx" && selExpr.Sel.Name == "Module" {
+								if xExpr.Name == af.imports[UBER_FX_MODULE] && selExpr.Sel.Name == "Module" {
 									af.existingModuleVar = valSpec.Names[valSpecIdx].Name
 									return true
 								}
@@ -551,10 +910,14 @@ func (af *analyzedFile) pass1Inspect(c *dstutil.Cursor) bool {
 //
 // )
 func (af *analyzedFile) getFxModuleDecl() *ast.GenDecl {
-	// Figure out name of fx module
-	fxModName := strings.Split(af.relPath, ".")[0]
-	fxModParts := strings.Split(fxModName, "/")
-	fxModName = ""
+	// Figure out name of fx module, e.g. SvcServerV2 for svc/server.v2.go,
+	// the same for the variants of a file, e.g. SvcConn for
+	// svc/conn_linux.go and svc/conn_windows.go
+	fxModPath := filepath.ToSlash(filepath.Join(filepath.Dir(af.relPath), af.analyzer.variantName(af.path)))
+	fxModParts := strings.FieldsFunc(fxModPath, func(r rune) bool {
+		return r == '/' || r == '.' || r == '-'
+	})
+	fxModName := ""
 	for _, part := range fxModParts {
 		fxModName += strings.ToUpper(part[0:1]) + part[1:]
 	}
@@ -562,17 +925,23 @@ func (af *analyzedFile) getFxModuleDecl() *ast.GenDecl {
 
 	fxModuleArgs := []ast.Expr{&ast.BasicLit{Value: fxModNameQuoted}}
 
-	for _, constructor := range af.constructors {
+	for _, name := range af.providerNames() {
+		ctor := af.ctors[name]
 		providerCall := &ast.CallExpr{
 			Fun: &ast.SelectorExpr{
-				X:   &ast.Ident{Name: "fx"},
+				X:   &ast.Ident{Name: af.fxName},
 				Sel: &ast.Ident{Name: "Provide"}},
-			Args: []ast.Expr{&ast.Ident{Name: constructor.Name.Name}}}
+			Args: []ast.Expr{af.getProvided(ctor)}}
 		fxModuleArgs = append(fxModuleArgs, providerCall)
 	}
+	for _, name := range af.suppliedVars {
+		fxModuleArgs = append(fxModuleArgs, &ast.CallExpr{
+			Fun:  &ast.SelectorExpr{X: &ast.Ident{Name: af.fxName}, Sel: &ast.Ident{Name: "Supply"}},
+			Args: []ast.Expr{&ast.Ident{Name: name}}})
+	}
 
 	fxModuleCall := &ast.CallExpr{
-		Fun:  &ast.SelectorExpr{X: &ast.Ident{Name: "fx"}, Sel: &ast.Ident{Name: "Module"}},
+		Fun:  &ast.SelectorExpr{X: &ast.Ident{Name: af.fxName}, Sel: &ast.Ident{Name: "Module"}},
 		Args: fxModuleArgs}
 
 	fxModuleVarDecl := &ast.GenDecl{
@@ -587,6 +956,54 @@ func (af *analyzedFile) getFxModuleDecl() *ast.GenDecl {
 	return fxModuleVarDecl
 }
 
+// Returns the expression passed to fx.Provide() for the constructor: the
+// constructor itself, or, if it needs annotations, e.g.
+//
+//	fx.Annotate(NewHandler, fx.As(new(Route)), fx.ResultTags(`group:"routes"`))
+func (af *analyzedFile) getProvided(ctor *ctorInfo) ast.Expr {
+	// Not an identifier for instantiations of generic constructors.
+	provided, err := parser.ParseExpr(ctor.providerName())
+	if err != nil {
+		af.err = af.errorAt(ctor.decl, DIAG_INTERNAL, "cannot provide %s: %s", ctor.providerName(), err)
+		provided = &ast.Ident{Name: ctor.providerName()}
+	}
+	annotations := make([]ast.Expr, 0)
+	for _, as := range ctor.as {
+		asType, err := parser.ParseExpr(as)
+		if err != nil {
+			af.err = af.errorAt(ctor.decl, DIAG_SYNTAX, "malformed %s%s %s: %s", DIRECTIVE_PREFIX, asDirective, as, err)
+			continue
+		}
+		annotations = append(annotations, &ast.CallExpr{
+			Fun: &ast.SelectorExpr{X: &ast.Ident{Name: af.fxName}, Sel: &ast.Ident{Name: "As"}},
+			Args: []ast.Expr{&ast.CallExpr{
+				Fun:  &ast.Ident{Name: "new"},
+				Args: []ast.Expr{asType},
+			}},
+		})
+	}
+	resultTag := structTag{}
+	if ctor.name != "" {
+		resultTag.add("name", ctor.name)
+	}
+	if ctor.group != "" {
+		resultTag.add("group", ctor.group)
+	}
+	if !resultTag.empty() {
+		annotations = append(annotations, &ast.CallExpr{
+			Fun:  &ast.SelectorExpr{X: &ast.Ident{Name: af.fxName}, Sel: &ast.Ident{Name: "ResultTags"}},
+			Args: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: "`" + resultTag.String() + "`"}},
+		})
+	}
+	if len(annotations) == 0 {
+		return provided
+	}
+	return &ast.CallExpr{
+		Fun:  &ast.SelectorExpr{X: &ast.Ident{Name: af.fxName}, Sel: &ast.Ident{Name: "Annotate"}},
+		Args: append([]ast.Expr{provided}, annotations...),
+	}
+}
+
 // Prepare param struct declarations for all structs that have constructors.
 // This is done in a separate pass because we need to know all the constructors.
 // We will then pass it to the astutil.Apply() function to do the actual
@@ -602,8 +1019,8 @@ func (af *analyzedFile) prepareParamStructs() error {
 	}
 
 	for _, structType := range af.structTypes {
-		if af.constructors[structType.Name.Name] == nil {
-			log.Printf("Ignoring struct %s as it does not have a constructor", structType.Name.Name)
+		if !af.needsParamStruct(structType.Name.Name) {
+			af.skip(structType.Name.Name, "it has no constructor")
 			continue
 		}
 
@@ -613,9 +1030,16 @@ func (af *analyzedFile) prepareParamStructs() error {
 
 		// Add fx.In as first field
 		paramStructFields.List = append(paramStructFields.List, &dst.Field{
-			Type: &dst.Ident{Name: "fx.In"},
+			Type: &dst.Ident{Name: af.fxName + ".In"},
 		})
 
+		fieldNames := make(map[string]bool)
+		for _, field := range structType.Type.(*dst.StructType).Fields.List {
+			for _, name := range field.Names {
+				fieldNames[name.Name] = true
+			}
+		}
+
 		// We want a deep copy, I think, because otherwise we'll end up with
 		// duplicated node error.
 		// But really?
@@ -628,26 +1052,67 @@ func (af *analyzedFile) prepareParamStructs() error {
 			// 	Decs  FieldDecorations
 			// }
 
-			newField := &dst.Field{}
-			switch fieldType := field.Type.(type) {
-			case *dst.StarExpr:
-				break
-			case *dst.SelectorExpr:
-				newField.Type = &dst.SelectorExpr{}
-				newField.Type.(*dst.SelectorExpr).X = &dst.Ident{Name: fieldType.X.(*dst.Ident).Name}
-				newField.Type.(*dst.SelectorExpr).Sel = &dst.Ident{Name: fieldType.Sel.Name}
-			case *dst.Ident:
-				newField.Type = &dst.Ident{Name: field.Type.(*dst.Ident).Name}
-			default:
-				log.Printf("Unexpected type for field %+v, ignoring for now", field.Type)
+			if len(field.Names) == 0 {
+				// Embedded field, copied as is.
+				paramStructFields.List = append(paramStructFields.List, &dst.Field{
+					Type: dst.Clone(field.Type).(dst.Expr),
+				})
+				continue
 			}
 
-			newField.Names = make([]*dst.Ident, 0)
-			for fieldName := range field.Names {
-				newField.Names = append(newField.Names, &dst.Ident{Name: field.Names[fieldName].Name})
+			// fx.In only injects exported fields, so unexported fields of the
+			// original struct get exported names in the params struct and a
+			// diutils tag pointing back at the original field. Fields may get
+			// other tags as well, in which case they are split into one field
+			// per name.
+			tags := make([]structTag, len(field.Names))
+			needsSplit := false
+			for i, name := range field.Names {
+				if !dst.IsExported(name.Name) {
+					tags[i].add(DIUTILS_TAG, "target="+name.Name)
+				}
+				if depName := af.fieldDirectives(field).get(nameDirective); depName != "" {
+					tags[i].add("name", depName)
+				} else if depName := af.analyzer.fieldName(af, structType.Name.Name, name.Name); depName != "" {
+					tags[i].add("name", depName)
+				}
+				if group := af.fieldGroup(structType.Name.Name, name.Name); group != "" {
+					tags[i].add("group", group)
+				} else if af.analyzer.isOptionalField(af, structType.Name.Name, field, name.Name) {
+					tags[i].add("optional", "true")
+				}
+				if !tags[i].empty() {
+					needsSplit = true
+				}
+			}
+			if !needsSplit {
+				newField := &dst.Field{Type: dst.Clone(field.Type).(dst.Expr)}
+				for _, name := range field.Names {
+					newField.Names = append(newField.Names, &dst.Ident{Name: name.Name})
+				}
+				paramStructFields.List = append(paramStructFields.List, newField)
+				continue
 			}
+			for i, name := range field.Names {
+				if name.Name == "_" {
+					continue
+				}
+				newField := &dst.Field{Type: dst.Clone(field.Type).(dst.Expr)}
+				paramName := name.Name
+				if !dst.IsExported(paramName) {
+					paramName = exportedName(paramName)
+					if fieldNames[paramName] || paramName == name.Name {
+						return af.errorAt(name, DIAG_EXPORT, "cannot export field %s.%s as %s", structType.Name.Name, name.Name, paramName)
+					}
+				}
+				newField.Names = []*dst.Ident{{Name: paramName}}
+				newField.Tag = tags[i].lit()
+				paramStructFields.List = append(paramStructFields.List, newField)
+			}
+		}
 
-			paramStructFields.List = append(paramStructFields.List, newField)
+		if hooks := af.structLifecycle(structType.Name.Name); hooks != nil {
+			paramStructFields.List = append(paramStructFields.List, hooks.getParamField(af.fxName))
 		}
 
 		paramStruct := &dst.StructType{
@@ -668,10 +1133,21 @@ func (af *analyzedFile) prepareParamStructs() error {
 	return nil
 }
 
+// Mark the struct as not to be rewritten.
+func (af *analyzedFile) skipStruct(name string) {
+	af.skip(name, "marked "+DIRECTIVE_PREFIX+skipDirective)
+	if af.skippedStructs == nil {
+		af.skippedStructs = make(map[string]bool)
+	}
+	af.skippedStructs[name] = true
+}
+
 // Pass 1 -- inspect the file and collect information about it.
 // Errors to be collected in af.err
 func (af *analyzedFile) doPass1() {
 	dstutil.Apply(af.dstFile, nil, af.pass1Inspect)
+	af.chooseCtors()
+	af.applySkipDirectives()
 }
 
 // Return true if there were any changes to the file.
@@ -680,11 +1156,17 @@ func (af *analyzedFile) process() (bool, error) {
 		return false, af.err
 	}
 
-	if af.constructors == nil || len(af.constructors) == 0 {
-		log.Printf("Skipping post-processing for %s -- no constructors\n", af.relPath)
+	if af.ignored {
+		return false, nil
+	}
+
+	if len(af.providerNames()) == 0 && len(af.suppliedVars) == 0 {
+		af.skip("", "no constructors")
 		return false, nil
 	}
 
+	af.resolveImportNames()
+
 	// astutil.Apply(af.topNode, af.applyPre, af.applyPost)
 	err := af.prepareParamStructs()
 	if err != nil {
@@ -697,76 +1179,105 @@ func (af *analyzedFile) process() (bool, error) {
 		return false, af.err
 	}
 
+	err = af.addModuleVar()
+	if err != nil {
+		return false, err
+	}
+	af.addImports()
+
 	return true, nil
 }
 
 func (af *analyzedFile) write() error {
-	fset := token.NewFileSet()
-	newPath := strings.Split(af.path, ".")[0] + "_new.go"
-	fset.AddFile(newPath, fset.Base(), 0)
-
-	outFile, err := os.OpenFile(newPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	err := af.analyzer.writeFile(newPath(af.path), af.dstFile)
 	if err != nil {
-		return err
+		return af.errorAt(nil, DIAG_WRITE, "%s", err)
 	}
+	af.written = true
+	return nil
+}
 
+func (a *Analyzer) writeFile(newPath string, dstFile *dst.File) error {
+	var buf bytes.Buffer
 	// err = printer.Fprint(outFile, fset, af.topNode)
 	restorer := decorator.NewRestorer()
 	fileRestorer := restorer.FileRestorer()
-	err = fileRestorer.Fprint(outFile, af.dstFile)
-
+	err := fileRestorer.Fprint(&buf, dstFile)
 	if err != nil {
 		return err
 	}
-	outFile.Close()
-	log.Printf("Wrote %s\n", newPath)
+	err = a.writeOutput(newPath, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	a.infof("Wrote %s", newPath)
 
 	return nil
 }
 
-func (a *Analyzer) analyzeFile(path string) error {
+// Returns true if the diutils package is imported from the analyzed module
+// rather than from the fxforce5 module.
+func (a *Analyzer) diutilsLocal() bool {
+	return DIUTILS_LOCAL && a.diutilsVersion == ""
+}
+
+// Parse the file and inspect it (pass 1). Returns nil if the file is not to
+// be rewritten.
+func (a *Analyzer) inspectFile(path string) (af *analyzedFile, err error) {
+	defer a.recoverPanic(path, &err)
 	fset := token.NewFileSet()
-	log.Printf("Analyzing %s\n", path)
+	a.debugf("Analyzing %s", path)
 
 	// TODO make this dynamic -- we'll get it from the CLI flags
-	diutilsImportPath := DIUTILS_IMPORT
-	if DIUTILS_LOCAL {
-		diutilsImportPath = a.modPath + "/diutils"
+	module := a.moduleOf(path)
+	if module == nil {
+		a.debugf("Skipping %s -- not in any module", path)
+		return nil, nil
+	}
+	diutilsImportPath, _ := strconv.Unquote(DIUTILS_IMPORT)
+	if a.diutilsLocal() {
+		diutilsImportPath = module.path + "/" + a.diutilsDir
 	}
 
-	dstFile, err := decorator.ParseFile(fset, path, nil, parser.ParseComments)
+	dec := decorator.NewDecorator(fset)
+	dstFile, err := dec.ParseFile(path, nil, parser.ParseComments)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Check if we already processed this file
 	beforeDecs := dstFile.Decs.Start.All()
 	for _, s := range beforeDecs {
 		if s == PROCESSED_DIRECTIVE {
-			log.Printf("Skipping %s -- already processed\n", path)
-			return nil
+			a.debugf("Skipping %s -- already processed", path)
+			return nil, nil
 		}
 	}
 
-	af := &analyzedFile{
+	af = &analyzedFile{
+		analyzer:          a,
+		module:            module,
 		path:              path,
 		diutilsImportPath: diutilsImportPath,
-		relPath:           path[len(a.path+"/src/"):],
-		dstFile:           dstFile}
+		relPath:           a.relPath(path),
+		pkgPath:           a.importPath(filepath.Dir(path)),
+		dstFile:           dstFile,
+		decorator:         dec,
+		pkg:               a.packageOf(path, dstFile.Name.Name)}
 
 	// Pass 1.
 	// Inspect the file and collect information about it.
 	af.doPass1()
+	return af, nil
+}
 
-	// Pass 2.
-	processed, err := af.process()
-	if err != nil {
-		return err
-	}
-	if !processed {
-		log.Printf("No changes for %s\n", path)
-		return nil
+// Rewrite the file (pass 2), without writing it yet. Returns true if there
+// were any changes to the file.
+func (af *analyzedFile) rewrite() (rewritten bool, err error) {
+	defer af.analyzer.recoverPanic(af.path, &err)
+	rewritten, err = af.process()
+	if err == nil && !rewritten {
+		af.analyzer.debugf("No changes for %s", af.path)
 	}
-	err = af.write()
-	return err
+	return rewritten, err
 }
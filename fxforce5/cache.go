@@ -0,0 +1,328 @@
+package fxforce5
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// The results of the analysis of each package are cached on disk (see
+// WithCacheDir()), so that packages that did not change since the last run
+// are not rewritten again, e.g. when fxforce5 runs from go:generate or a
+// pre-commit hook. The key of a package covers everything its rewrite
+// depends on: fxforce5 itself and its options, the Go files of the package
+// and of the packages of the analyzed modules it imports, and what is
+// gathered across all packages before the walk (named dependencies,
+// optional fields, instantiations of generic constructors). For an
+// unchanged package whose rewritten files are still there, only what other
+// packages need is loaded from the cache: its rewritten constructors and
+// the named dependencies it provides, as well as its report.
+//
+// The cache only saves rewriting and writing the files of unchanged
+// packages. All packages are still loaded with go/packages, with their
+// syntax and type information, and all of them are needed for what is
+// gathered across packages before the cache is looked up, so a run with an
+// up-to-date cache still takes most of the time of loading the modules.
+
+const (
+	// Version of the format of the cache entries.
+	CACHE_VERSION = "3"
+	// Directory of the cache under os.UserCacheDir().
+	CACHE_SUBDIR = "fxforce5"
+)
+
+// Results of the analysis of a package, as cached.
+type cacheEntry struct {
+	// Files written, with their SHA-256.
+	Outputs []cachedOutput `json:"outputs"`
+	// Original names of the rewritten constructors.
+	RenamedCtors []string `json:"renamedCtors"`
+	// Named dependencies of the structs of the package, emitted or not,
+	// and those provided by its constructors.
+	NamedDeps []cachedNamedDep `json:"namedDeps"`
+	// Report of the analysis of the package, see analysisReport().
+	Report *PackageReport `json:"report"`
+}
+
+type cachedOutput struct {
+	// Name of the file, in the directory of the package.
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+}
+
+type cachedNamedDep struct {
+	Key      string `json:"key"`
+	Emitted  bool   `json:"emitted,omitempty"`
+	Provider string `json:"provider,omitempty"`
+}
+
+// DefaultCacheDir returns the default cache directory, see WithCacheDir(),
+// or "" if there is none.
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, CACHE_SUBDIR)
+}
+
+// Returns the digest of what the rewrite of every package depends on,
+// besides its own files.
+func (a *Analyzer) cacheDigest() string {
+	lines := []string{"version " + CACHE_VERSION, "fxforce5 " + executableHash()}
+	for _, rule := range a.groupRules {
+		lines = append(lines, "group "+rule.String())
+	}
+	for _, pattern := range a.ctorPatterns {
+		lines = append(lines, "ctor-pattern "+pattern.String())
+	}
+	for _, t := range TRANSFORMATIONS {
+		if a.applies(t) {
+			lines = append(lines, "transform "+string(t))
+		}
+	}
+	lines = append(lines,
+		"fx "+a.fxVersion,
+		"diutils "+a.diutilsVersion+" "+a.diutilsDir,
+		"tags "+strings.Join(a.buildTags, ","))
+
+	// Gathered across packages, in no particular order. Only the named
+	// dependencies of analyzed packages and the instantiations of their
+	// generics count, e.g. not those of the diutils package written by the
+	// previous run.
+	analyzedPkgs := make(map[string]bool)
+	for _, pkg := range a.packages {
+		for _, path := range pkg.GoFiles {
+			if a.visited[path] {
+				analyzedPkgs[pkg.PkgPath] = true
+			}
+		}
+	}
+	gathered := make([]string, 0)
+	for _, key := range a.namedDepKeys() {
+		dep := a.namedDeps[key]
+		if analyzedPkgs[dep.Package] {
+			gathered = append(gathered, "named "+key+" "+dep.Name+" "+dep.Type)
+		}
+	}
+	for key := range a.optionalFields {
+		gathered = append(gathered, "optional "+key)
+	}
+	for _, pkg := range a.packages {
+		if pkg.TypesInfo == nil {
+			continue
+		}
+		for ident, inst := range pkg.TypesInfo.Instances {
+			obj := pkg.TypesInfo.Uses[ident]
+			if obj == nil || obj.Pkg() == nil || !analyzedPkgs[obj.Pkg().Path()] {
+				continue
+			}
+			args := make([]string, inst.TypeArgs.Len())
+			for i := range args {
+				args[i] = types.TypeString(inst.TypeArgs.At(i), nil)
+			}
+			gathered = append(gathered, "instance "+obj.Pkg().Path()+"."+obj.Name()+"["+strings.Join(args, ",")+"]")
+		}
+	}
+	sort.Strings(gathered)
+	lines = append(lines, gathered...)
+	return sha256Hex([]byte(strings.Join(lines, "\n")))
+}
+
+// Returns the SHA-256 of the running executable, so that the cache of
+// another version of fxforce5 is not used, or "" if it cannot be read.
+func executableHash() string {
+	path, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return sha256Hex(buf)
+}
+
+// Returns the cache key of the package in the directory, made of the files
+// to analyze.
+func (a *Analyzer) cacheKey(dir string, files []string, digest string, dirHashes map[string]string) (string, error) {
+	lines := []string{"digest " + digest, "package " + a.importPath(dir)}
+	for _, path := range files {
+		if !isRewrittenFile(path) {
+			lines = append(lines, "file "+filepath.Base(path))
+		}
+	}
+	dirs := []string{dir}
+	if pkg := a.pkgByFile[files[0]]; pkg != nil {
+		for _, rule := range a.groupRules {
+			if named := a.lookupNamed(rule.Interface, pkg); named != nil {
+				lines = append(lines, "interface "+rule.Interface+" "+types.TypeString(named.Underlying(), nil))
+			}
+		}
+		visited := make(map[string]bool)
+		var visit func(pkg *packages.Package)
+		visit = func(pkg *packages.Package) {
+			for _, imported := range pkg.Imports {
+				if visited[imported.PkgPath] || len(imported.GoFiles) == 0 {
+					continue
+				}
+				visited[imported.PkgPath] = true
+				importedDir := filepath.Dir(imported.GoFiles[0])
+				if a.moduleOf(importedDir) == nil {
+					continue
+				}
+				dirs = append(dirs, importedDir)
+				visit(imported)
+			}
+		}
+		visit(pkg)
+	}
+	for _, d := range dirs {
+		hash, ok := dirHashes[d]
+		if !ok {
+			var err error
+			hash, err = hashGoFiles(d)
+			if err != nil {
+				return "", err
+			}
+			dirHashes[d] = hash
+		}
+		lines = append(lines, "dir "+a.importPath(d)+" "+hash)
+	}
+	sort.Strings(lines[2:])
+	return sha256Hex([]byte(strings.Join(lines, "\n"))), nil
+}
+
+// Returns the SHA-256 of the Go files of the directory, but for the
+// rewritten ones fxforce5 writes.
+func hashGoFiles(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	lines := make([]string, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || isRewrittenFile(name) {
+			continue
+		}
+		buf, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, name+" "+sha256Hex(buf))
+	}
+	return sha256Hex([]byte(strings.Join(lines, "\n"))), nil
+}
+
+// Returns the path of the cache entry with the key.
+func (a *Analyzer) cachePath(key string) string {
+	return filepath.Join(a.cacheDir, key[:2], key+".json")
+}
+
+// Returns the cache entry of the package in the directory, or nil if there
+// is none or the files it wrote changed since.
+func (a *Analyzer) loadCacheEntry(dir string, key string) *cacheEntry {
+	buf, err := os.ReadFile(a.cachePath(key))
+	if err != nil {
+		return nil
+	}
+	entry := &cacheEntry{}
+	err = json.Unmarshal(buf, entry)
+	if err == nil && entry.Report == nil {
+		err = errors.New("no report")
+	}
+	if err != nil {
+		a.warnf("Ignoring cache entry %s: %s", a.cachePath(key), err)
+		return nil
+	}
+	for _, output := range entry.Outputs {
+		buf, err := os.ReadFile(filepath.Join(dir, output.Name))
+		if err != nil || sha256Hex(buf) != output.Hash {
+			return nil
+		}
+	}
+	return entry
+}
+
+// Restore what other packages need from the cache entry of the package.
+func (a *Analyzer) restoreCacheEntry(dir string, entry *cacheEntry) {
+	pkgPath := a.importPath(dir)
+	if m := a.moduleOf(dir); m != nil && len(entry.Outputs) > 0 {
+		m.rewritten = true
+	}
+	for _, name := range entry.RenamedCtors {
+		a.rewrittenCtors[pkgPath+"."+name] = true
+	}
+	for _, cached := range entry.NamedDeps {
+		dep := a.namedDeps[cached.Key]
+		if dep == nil {
+			continue
+		}
+		if cached.Emitted {
+			dep.emitted = true
+		}
+		if cached.Provider != "" {
+			dep.Provider = cached.Provider
+			dep.providerPkg = pkgPath
+		}
+	}
+}
+
+// Returns the cache entry of the package in the directory, once analyzed.
+func (a *Analyzer) newCacheEntry(dir string, files []*analyzedFile, report *PackageReport) (*cacheEntry, error) {
+	pkgPath := a.importPath(dir)
+	entry := &cacheEntry{Outputs: []cachedOutput{}, RenamedCtors: []string{}, NamedDeps: []cachedNamedDep{}, Report: report}
+	for _, af := range files {
+		if af == nil || !af.written {
+			continue
+		}
+		buf, err := os.ReadFile(newPath(af.path))
+		if err != nil {
+			return nil, err
+		}
+		entry.Outputs = append(entry.Outputs, cachedOutput{Name: filepath.Base(newPath(af.path)), Hash: sha256Hex(buf)})
+		entry.RenamedCtors = append(entry.RenamedCtors, af.renamedCtors...)
+	}
+	for _, key := range a.namedDepKeys() {
+		dep := a.namedDeps[key]
+		cached := cachedNamedDep{Key: key}
+		if dep.Package == pkgPath {
+			cached.Emitted = dep.emitted
+		}
+		if dep.providerPkg == pkgPath {
+			cached.Provider = dep.Provider
+		}
+		if cached.Emitted || cached.Provider != "" {
+			entry.NamedDeps = append(entry.NamedDeps, cached)
+		}
+	}
+	return entry, nil
+}
+
+// Write the cache entry. Errors are not fatal, the cache is only an
+// optimization.
+func (a *Analyzer) storeCacheEntry(key string, entry *cacheEntry) {
+	buf, err := json.MarshalIndent(entry, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(a.cachePath(key)), 0755)
+	}
+	if err == nil {
+		// Through a temporary file, for concurrent runs.
+		tmp := fmt.Sprintf("%s.%d", a.cachePath(key), os.Getpid())
+		err = os.WriteFile(tmp, buf, 0644)
+		if err == nil {
+			err = os.Rename(tmp, a.cachePath(key))
+		}
+	}
+	if err != nil {
+		a.warnf("Not caching %s: %s", key, err)
+	}
+}
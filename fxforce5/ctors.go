@@ -0,0 +1,281 @@
+package fxforce5
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/debedb/fxforce5/diutils"
+)
+
+// Constructors are exported functions whose name matches one of the
+// constructor patterns and whose (first) result is a type declared in the
+// package, T or *T. The type is derived from the result, not from the name,
+// so NewServerFromConfig constructs Server.
+//
+// Default pattern for constructor names: New, followed by anything but a
+// lower-case letter (so Newsletter is not a constructor).
+const DEFAULT_CTOR_PATTERN = `^New($|[^a-z])`
+
+var defaultCtorPattern = regexp.MustCompile(DEFAULT_CTOR_PATTERN)
+
+// Returns true if the function name matches the constructor patterns.
+func (a *Analyzer) isCtorName(name string) bool {
+	if len(a.ctorPatterns) == 0 {
+		return defaultCtorPattern.MatchString(name)
+	}
+	for _, pattern := range a.ctorPatterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// The constructor chosen for a type in a package, see findConstructors().
+type ctorChoice struct {
+	// Name of the constructor, "" if the choice is ambiguous or the type
+	// is skipped.
+	name string
+	// Whether the type is marked with the skip directive, in any file of
+	// the package.
+	skipped bool
+	// Whether it returns a pointer.
+	ptr bool
+	// Whether it has several results, in which case it does not take a
+	// params struct, see results.go.
+	multi bool
+}
+
+// Choose the constructor of typeName among several candidates: the only
+// one, or the one named New<typeName>. Returns "" if the choice is
+// ambiguous.
+func chooseCtor(typeName string, names []string) string {
+	if len(names) == 1 {
+		return names[0]
+	}
+	for _, name := range names {
+		if name == "New"+typeName {
+			return name
+		}
+	}
+	return ""
+}
+
+// Find the constructor candidates of every type across all files of each
+// package and choose one per type, so that a type with constructors in
+// several files does not end up provided more than once.
+func (a *Analyzer) findConstructors() {
+	a.ctorChoice = make(map[string]ctorChoice)
+	for _, pkg := range a.packages {
+		if pkg.TypesInfo == nil {
+			continue
+		}
+		candidates := make(map[string][]string)
+		ptr := make(map[string]bool)
+		multi := make(map[string]bool)
+		skipped := make(map[string]bool)
+		for _, file := range pkg.Syntax {
+			for _, decl := range file.Decls {
+				if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.TYPE {
+					for _, spec := range gen.Specs {
+						ts := spec.(*ast.TypeSpec)
+						if gen.Doc != nil && hasSkipDirective(gen.Doc) || ts.Doc != nil && hasSkipDirective(ts.Doc) {
+							skipped[ts.Name.Name] = true
+						}
+					}
+				}
+				fn, ok := decl.(*ast.FuncDecl)
+				if !ok || fn.Recv != nil || fn.Type.TypeParams != nil || !fn.Name.IsExported() || !a.isCtorName(fn.Name.Name) {
+					continue
+				}
+				if fn.Doc != nil && hasSkipDirective(fn.Doc) {
+					continue
+				}
+				obj, ok := pkg.TypesInfo.Defs[fn.Name].(*types.Func)
+				if !ok {
+					continue
+				}
+				sig := obj.Type().(*types.Signature)
+				key, isMulti := ctorTypeKey(pkg.Types, sig)
+				if key != "" {
+					candidates[key] = append(candidates[key], fn.Name.Name)
+					_, ptr[fn.Name.Name] = sig.Results().At(0).Type().(*types.Pointer)
+					multi[fn.Name.Name] = isMulti
+				}
+			}
+		}
+		for key, names := range candidates {
+			if skipped[key] {
+				a.ctorChoice[pkg.PkgPath+"."+key] = ctorChoice{skipped: true}
+				continue
+			}
+			sort.Strings(names)
+			chosen := chooseCtor(key, names)
+			if chosen == "" {
+				a.warnf("%s: %s has several constructors %s, not rewriting any -- mark all but one %s%s", pkg.PkgPath, key, names, DIRECTIVE_PREFIX, skipDirective)
+			} else if len(names) > 1 {
+				a.infof("%s: %s has several constructors %s, rewriting %s", pkg.PkgPath, key, names, chosen)
+			}
+			a.ctorChoice[pkg.PkgPath+"."+key] = ctorChoice{name: chosen, ptr: ptr[chosen], multi: multi[chosen]}
+		}
+	}
+}
+
+// Returns the name of the type constructed by a function with the
+// signature: the local struct it returns, or for several results the first
+// one, and whether it has several results. Returns "" if the function is
+// not a constructor that is rewritten, e.g. if it returns the same type
+// more than once.
+func ctorTypeKey(pkg *types.Package, sig *types.Signature) (string, bool) {
+	results := sig.Results()
+	n := results.Len()
+	if n > 1 && isErrorTypesType(results.At(n-1).Type()) {
+		n--
+	}
+	if n == 0 {
+		return "", false
+	}
+	t := results.At(0).Type()
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	named, ok := t.(*types.Named)
+	if !ok || named.TypeArgs().Len() > 0 {
+		return "", false
+	}
+	if n > 1 {
+		for i := 1; i < n; i++ {
+			for j := 0; j < i; j++ {
+				if types.Identical(results.At(i).Type(), results.At(j).Type()) {
+					// Not rewritten, see results.go.
+					return "", false
+				}
+			}
+		}
+		return named.Obj().Name(), true
+	}
+	if _, ok := named.Underlying().(*types.Struct); !ok || named.Obj().Pkg() != pkg {
+		return "", false
+	}
+	return named.Obj().Name(), false
+}
+
+// Returns true if the doc comment has the skip directive.
+func hasSkipDirective(doc *ast.CommentGroup) bool {
+	for _, comment := range doc.List {
+		if strings.TrimSpace(comment.Text) == DIRECTIVE_PREFIX+skipDirective {
+			return true
+		}
+	}
+	return false
+}
+
+// Choose one constructor per type among the candidates found in pass 1,
+// following the choice made for the whole package if type information is
+// available, and among the candidates in the file otherwise.
+func (af *analyzedFile) chooseCtors() {
+	af.ctors = make(map[string]*ctorInfo)
+	for key, candidates := range af.ctorCandidates {
+		if !candidates[0].rewritten() {
+			// Keyed by the constructor name, so there is only one.
+			af.ctors[key] = candidates[0]
+			continue
+		}
+		names := make([]string, 0, len(candidates))
+		for _, ctor := range candidates {
+			names = append(names, ctor.providerName())
+		}
+		sort.Strings(names)
+		choice, ok := af.packageCtor(key)
+		if choice.skipped {
+			for _, ctor := range candidates {
+				af.skip(ctor.providerName(), key+" is marked "+DIRECTIVE_PREFIX+skipDirective)
+			}
+			continue
+		}
+		chosen := choice.name
+		if !ok {
+			chosen = chooseCtor(key, names)
+			if chosen == "" {
+				af.skip(key, fmt.Sprintf("it has several constructors %s, mark all but one %s%s", names, DIRECTIVE_PREFIX, skipDirective))
+			}
+		}
+		for _, ctor := range candidates {
+			if ctor.providerName() == chosen {
+				af.ctors[key] = ctor
+			} else {
+				af.skip(ctor.providerName(), chosen+" is the constructor of "+key)
+			}
+		}
+	}
+}
+
+// Returns the constructor chosen for the type among those of the whole
+// package, if type information is available.
+func (af *analyzedFile) packageCtor(typeName string) (ctorChoice, bool) {
+	choice, ok := af.analyzer.ctorChoice[af.pkgPath+"."+typeName]
+	return choice, ok
+}
+
+// Returns true if a params struct is needed for the struct declared in the
+// file: it has a rewritten constructor with a single result, in this file
+// or in another file of the package.
+func (af *analyzedFile) needsParamStruct(structName string) bool {
+	if af.structCtor(structName) != nil {
+		return true
+	}
+	choice, ok := af.packageCtor(structName)
+	return ok && choice.name != "" && !choice.multi && af.localNamed(structName) != nil
+}
+
+// Returns true if diutils can fail constructing the local struct, so that
+// the generated constructor has to return an error rather than panic in
+// fx: the struct has default tags, which may not parse, or a Validate()
+// error method, see diutils.Validator.
+func (af *analyzedFile) constructCanFail(structName string) bool {
+	if named := af.localNamed(structName); named != nil {
+		if st, ok := named.Underlying().(*types.Struct); ok {
+			for i := 0; i < st.NumFields(); i++ {
+				if _, ok := reflect.StructTag(st.Tag(i)).Lookup(diutils.DEFAULT_TAG); ok {
+					return true
+				}
+			}
+		}
+		return hasMethod(types.NewMethodSet(types.NewPointer(named)), "Validate", false)
+	}
+
+	// Without type information, only the declarations of this file are
+	// known.
+	for _, spec := range af.structTypes {
+		if spec.Name.Name != structName {
+			continue
+		}
+		for _, field := range spec.Type.(*dst.StructType).Fields.List {
+			if field.Tag == nil {
+				continue
+			}
+			tag, err := strconv.Unquote(field.Tag.Value)
+			if err != nil {
+				continue
+			}
+			if _, ok := reflect.StructTag(tag).Lookup(diutils.DEFAULT_TAG); ok {
+				return true
+			}
+		}
+	}
+	for _, decl := range af.dstFile.Decls {
+		fn, ok := decl.(*dst.FuncDecl)
+		if ok && fn.Recv != nil && len(fn.Recv.List) == 1 && fn.Name.Name == "Validate" && recvTypeName(fn.Recv.List[0].Type) == structName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package fxforce5
+
+import (
+	"errors"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dave/dst"
+	"golang.org/x/tools/go/packages"
+)
+
+// Problems found in the analyzed code are reported as diagnostics, with
+// their positions, in the report of the package (see PackageReport). A file
+// with an error is not rewritten; by default the run stops once a step
+// finds errors, before anything is written, unless WithKeepGoing() is
+// given, in which case the other files are rewritten. Either way, Analyze()
+// returns an error if there was any.
+
+// Severity of a diagnostic.
+type Severity string
+
+const (
+	// The file is not rewritten.
+	SEVERITY_ERROR Severity = "error"
+	// The file is rewritten, possibly with less than it could be.
+	SEVERITY_WARNING Severity = "warning"
+)
+
+// Codes of diagnostics.
+const (
+	// The file does not parse.
+	DIAG_SYNTAX = "syntax"
+	// A //go:build line does not parse.
+	DIAG_BUILD_CONSTRAINT = "build-constraint"
+	// The package does not type-check, so its files are rewritten without
+	// type information.
+	DIAG_TYPE = "type"
+	// The packages cannot be loaded, e.g. the go command fails.
+	DIAG_LOAD = "load"
+	// A constructor returns a type that cannot be rewritten.
+	DIAG_RESULT_TYPE = "result-type"
+	// A field or result cannot be given an exported name.
+	DIAG_EXPORT = "export"
+	// The rewritten file cannot be written.
+	DIAG_WRITE = "write"
+	// A bug in fxforce5.
+	DIAG_INTERNAL = "internal"
+	// Anything else.
+	DIAG_ERROR = "error"
+)
+
+// Diagnostic is a problem found in a file. The file name of the position is
+// relative to the analyzed directory; the line is 0 if the position in the
+// file is not known.
+type Diagnostic struct {
+	Pos      token.Position `json:"pos"`
+	Severity Severity       `json:"severity"`
+	Code     string         `json:"code"`
+	Message  string         `json:"message"`
+}
+
+// Returns the diagnostic as file:line:column: severity: message (code).
+func (d *Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s: %s (%s)", d.Pos, d.Severity, d.Message, d.Code)
+}
+
+func (d *Diagnostic) Error() string {
+	return d.String()
+}
+
+// Returns an error diagnostic at the node of the file, or at the file if the
+// node is nil or was not parsed from it.
+func (af *analyzedFile) errorAt(node dst.Node, code string, format string, args ...interface{}) *Diagnostic {
+	pos := token.Position{Filename: af.analyzer.dirRelPath(af.path)}
+	if node != nil && af.decorator != nil {
+		if astNode := af.decorator.Map.Ast.Nodes[node]; astNode != nil {
+			pos = af.decorator.Fset.Position(astNode.Pos())
+			pos.Filename = af.analyzer.dirRelPath(pos.Filename)
+		}
+	}
+	return &Diagnostic{Pos: pos, Severity: SEVERITY_ERROR, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Record a warning at the node of the file, see errorAt().
+func (af *analyzedFile) warnAt(node dst.Node, code string, format string, args ...interface{}) {
+	d := af.errorAt(node, code, format, args...)
+	d.Severity = SEVERITY_WARNING
+	af.analyzer.warnf("%s", d)
+	af.diagnostics = append(af.diagnostics, *d)
+}
+
+// Returns the diagnostic of an error in analyzing the file at path.
+func (a *Analyzer) diagnostic(path string, err error) *Diagnostic {
+	var d *Diagnostic
+	if errors.As(err, &d) {
+		return d
+	}
+	var list scanner.ErrorList
+	if errors.As(err, &list) && len(list) > 0 {
+		pos := list[0].Pos
+		pos.Filename = a.dirRelPath(pos.Filename)
+		return &Diagnostic{Pos: pos, Severity: SEVERITY_ERROR, Code: DIAG_SYNTAX, Message: list[0].Msg}
+	}
+	return &Diagnostic{Pos: token.Position{Filename: a.dirRelPath(path)}, Severity: SEVERITY_ERROR, Code: DIAG_ERROR, Message: err.Error()}
+}
+
+// Record an error in analyzing the file at path.
+func (a *Analyzer) fileError(path string, err error) {
+	d := a.diagnostic(path, err)
+	a.errorf("%s", d)
+	r := a.packageReport(filepath.Dir(path))
+	r.Diagnostics = append(r.Diagnostics, *d)
+}
+
+// Record the errors found loading the package as warnings, as its files are
+// still rewritten. Syntax errors are reported by the files having them.
+// Errors without a position, e.g. of the go command, are not about the code
+// of the package, and are reported as errors.
+func (a *Analyzer) packageErrors(pkg *packages.Package) {
+	if len(pkg.Errors) == 0 || len(pkg.GoFiles) == 0 {
+		return
+	}
+	r := a.packageReport(filepath.Dir(pkg.GoFiles[0]))
+	for _, err := range pkg.Errors {
+		// Reported as errors of the files, see diagnostic().
+		if err.Kind == packages.ParseError {
+			continue
+		}
+		d := Diagnostic{Pos: parsePosition(err.Pos), Severity: SEVERITY_WARNING, Code: DIAG_TYPE, Message: err.Msg}
+		if d.Pos.Filename == "" {
+			d.Pos.Filename = r.Dir
+			d.Severity = SEVERITY_ERROR
+			d.Code = DIAG_LOAD
+			a.errorf("%s", &d)
+		} else {
+			d.Pos.Filename = a.dirRelPath(d.Pos.Filename)
+			a.warnf("%s", &d)
+		}
+		r.Diagnostics = append(r.Diagnostics, d)
+	}
+}
+
+// Record the error loading the packages of the module at root, in the
+// report of its root directory.
+func (a *Analyzer) loadError(root string, err error) {
+	r := a.packageReport(root)
+	d := Diagnostic{Pos: token.Position{Filename: r.Dir}, Severity: SEVERITY_ERROR, Code: DIAG_LOAD, Message: err.Error()}
+	a.errorf("%s", &d)
+	r.Diagnostics = append(r.Diagnostics, d)
+}
+
+// Returns the position given as file:line:column, file:line or file, as in
+// packages.Error.
+func parsePosition(s string) token.Position {
+	pos := token.Position{Filename: s}
+	for _, field := range []*int{&pos.Column, &pos.Line} {
+		i := strings.LastIndex(pos.Filename, ":")
+		if i < 0 {
+			break
+		}
+		n, err := strconv.Atoi(pos.Filename[i+1:])
+		if err != nil {
+			break
+		}
+		*field = n
+		pos.Filename = pos.Filename[:i]
+	}
+	if pos.Line == 0 && pos.Column != 0 {
+		pos.Line, pos.Column = pos.Column, 0
+	}
+	if pos.Filename == "-" {
+		pos.Filename = ""
+	}
+	return pos
+}
+
+// Turn a panic in analyzing the file at path into an error. Deferred by
+// the steps of the analysis of a file, so that a bug in fxforce5 only fails
+// the file it shows in.
+func (a *Analyzer) recoverPanic(path string, err *error) {
+	if r := recover(); r != nil {
+		*err = &Diagnostic{
+			Pos:      token.Position{Filename: a.dirRelPath(path)},
+			Severity: SEVERITY_ERROR,
+			Code:     DIAG_INTERNAL,
+			Message:  fmt.Sprintf("panic: %v", r),
+		}
+	}
+}
+
+// Returns the number of errors found so far.
+func (a *Analyzer) errorCount() int {
+	n := 0
+	for _, r := range a.reports {
+		n += r.errorCount()
+	}
+	return n
+}
+
+// Returns an error if there are errors and the run stops at them, see
+// WithKeepGoing().
+func (a *Analyzer) stopAtErrors() error {
+	if n := a.errorCount(); n > 0 && !a.keepGoing {
+		return fmt.Errorf("stopped after %d errors", n)
+	}
+	return nil
+}
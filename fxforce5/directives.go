@@ -0,0 +1,100 @@
+package fxforce5
+
+import (
+	"strings"
+
+	"github.com/dave/dst"
+)
+
+// Directives are comments controlling the rewriting of the declaration they
+// are attached to (as doc comments or, for fields, end of line comments):
+//
+//	//fxforce5:ignore-file   anywhere before the package clause: leave the file alone
+//	//fxforce5:skip          on a struct or constructor: do not rewrite it
+//	//fxforce5:name=primary  on a field: tag it `name:"primary"`
+//	//fxforce5:optional      on a field: tag it `optional:"true"`
+//	//fxforce5:group=routes  on a constructor: provide its result into the value group
+//	//fxforce5:as=Store      on a constructor: provide its result as the Store interface
+const DIRECTIVE_PREFIX = "//fxforce5:"
+
+const (
+	ignoreFileDirective = "ignore-file"
+	skipDirective       = "skip"
+	nameDirective       = "name"
+	optionalDirective   = "optional"
+	groupDirective      = "group"
+	asDirective         = "as"
+)
+
+// Directives parsed from decorations, mapping the directive to its value
+// ("" for directives without one). Directives that can be repeated (as=)
+// keep all values.
+type directives map[string][]string
+
+// Parse the directives out of the decorations.
+func (af *analyzedFile) parseDirectives(decorations ...dst.Decorations) directives {
+	var d directives
+	for _, decs := range decorations {
+		for _, dec := range decs.All() {
+			dec = strings.TrimSpace(dec)
+			if !strings.HasPrefix(dec, DIRECTIVE_PREFIX) {
+				continue
+			}
+			name, value, _ := strings.Cut(strings.TrimPrefix(dec, DIRECTIVE_PREFIX), "=")
+			switch name {
+			case ignoreFileDirective, skipDirective, nameDirective, optionalDirective, groupDirective, asDirective:
+			default:
+				af.analyzer.warnf("%s: Ignoring unknown directive %s", af.relPath, dec)
+				continue
+			}
+			if d == nil {
+				d = make(directives)
+			}
+			d[name] = append(d[name], strings.TrimSpace(value))
+		}
+	}
+	return d
+}
+
+// Returns true if the directive is present.
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// Returns the (last) value of the directive, or "".
+func (d directives) get(name string) string {
+	values := d[name]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+// Returns the directives of a field.
+func (af *analyzedFile) fieldDirectives(field *dst.Field) directives {
+	return af.parseDirectives(field.Decs.Start, field.Decs.End)
+}
+
+// Apply the directives of a constructor collected in pass 1.
+func (af *analyzedFile) applyCtorDirectives(ctor *ctorInfo, d directives) {
+	if group := d.get(groupDirective); group != "" {
+		ctor.group = group
+	}
+	for _, as := range d[asDirective] {
+		if as != "" {
+			ctor.as = append(ctor.as, as)
+		}
+	}
+}
+
+// Drop constructors of structs marked with the skip directive. Runs after
+// pass 1, as structs may be declared after their constructors.
+func (af *analyzedFile) applySkipDirectives() {
+	for name := range af.skippedStructs {
+		if ctor := af.ctors[name]; ctor != nil {
+			af.skip(ctor.providerName(), name+" is marked "+DIRECTIVE_PREFIX+skipDirective)
+			delete(af.ctors, name)
+		}
+	}
+}
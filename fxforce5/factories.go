@@ -0,0 +1,218 @@
+package fxforce5
+
+import (
+	"go/types"
+
+	"github.com/dave/dst"
+)
+
+// Besides plain functions, constructors can be methods of factories, such as
+//
+//	func (f *ClientFactory) NewClient(cfg Config) (*Client, error)
+//
+// which are provided by a generated function taking the factory as a
+// dependency:
+//
+//	func NewClientFromClientFactory(f *ClientFactory, cfg Config) (*Client, error) {
+//		return f.NewClient(cfg)
+//	}
+//
+// or package vars holding a constructor function, which are provided as they
+// are:
+//
+//	var NewClient = func(cfg Config) *Client { ... }
+//
+// Package vars holding a factory, such as
+//
+//	var Clients = &ClientFactory{}
+//
+// are provided with fx.Supply(Clients), unless the factory has a constructor
+// of its own. None of these are rewritten.
+
+// Returns the name of what is passed to fx.Provide() for the constructor.
+func (ctor *ctorInfo) providerName() string {
+	if ctor.provider != "" {
+		return ctor.provider
+	}
+	if ctor.renamed {
+		// The generated constructor, not NewXOrig.
+		return ctor.origName
+	}
+	return ctor.decl.Name.Name
+}
+
+// Returns the name of the local type of a method receiver, T or *T, or ""
+// for anything else, e.g. generic types.
+func recvTypeName(expr dst.Expr) string {
+	switch e := expr.(type) {
+	case *dst.StarExpr:
+		return recvTypeName(e.X)
+	case *dst.Ident:
+		return e.Name
+	}
+	return ""
+}
+
+// Collect the constructor method in pass 1.
+func (af *analyzedFile) inspectMethodCtor(decl *dst.FuncDecl) {
+	name := decl.Name.Name
+	if !dst.IsExported(name) || !af.analyzer.isCtorName(name) {
+		return
+	}
+	recvName := recvTypeName(decl.Recv.List[0].Type)
+	if recvName == "" {
+		af.skip(name, "unsupported receiver type")
+		return
+	}
+	methodName := recvName + "." + name
+	d := af.parseDirectives(decl.Decs.Start)
+	if d.has(skipDirective) {
+		af.skip(methodName, "marked "+DIRECTIVE_PREFIX+skipDirective)
+		return
+	}
+	ctor := af.newCtorInfo(methodName, decl.Type)
+	if ctor == nil || af.constructedElsewhere(ctor, methodName) {
+		return
+	}
+	ctor.decl = decl
+	ctor.provider = name + "From" + exportedName(recvName)
+	if af.pkg != nil && af.pkg.Types.Scope().Lookup(ctor.provider) != nil {
+		af.skip(methodName, ctor.provider+" is already declared")
+		return
+	}
+	af.applyCtorDirectives(ctor, d)
+	af.addCtorCandidate(ctor)
+}
+
+// Collect the package vars holding constructor functions or factories in
+// pass 1.
+func (af *analyzedFile) inspectFactoryVar(decl *dst.GenDecl, spec *dst.ValueSpec) {
+	d := af.parseDirectives(decl.Decs.Start, spec.Decs.Start)
+	if d.has(skipDirective) {
+		return
+	}
+	for i, name := range spec.Names {
+		if name.Name == "_" {
+			continue
+		}
+		funcType, _ := spec.Type.(*dst.FuncType)
+		if funcType == nil && i < len(spec.Values) {
+			if lit, ok := spec.Values[i].(*dst.FuncLit); ok {
+				funcType = lit.Type
+			}
+		}
+		if funcType == nil {
+			af.inspectFactoryValue(name.Name)
+			continue
+		}
+		if !dst.IsExported(name.Name) || !af.analyzer.isCtorName(name.Name) {
+			continue
+		}
+		ctor := af.newCtorInfo(name.Name, funcType)
+		if ctor == nil || af.constructedElsewhere(ctor, name.Name) {
+			continue
+		}
+		ctor.provider = name.Name
+		af.applyCtorDirectives(ctor, d)
+		af.addCtorCandidate(ctor)
+	}
+}
+
+// Returns true if the result of the factory is a local struct that has a
+// constructor function, which then is what provides it.
+func (af *analyzedFile) constructedElsewhere(ctor *ctorInfo, name string) bool {
+	if ctor.returnInfo.returnKind != structKind {
+		return false
+	}
+	choice, ok := af.packageCtor(ctor.returnInfo.name)
+	if !ok || choice.name == "" {
+		return false
+	}
+	af.analyzer.debugf("%s: Skipping %s -- %s is the constructor of %s", af.relPath, name, choice.name, ctor.returnInfo.name)
+	return true
+}
+
+// Supply the package var if it holds a factory, i.e. a value of a local type
+// with constructor methods. Needs type information.
+func (af *analyzedFile) inspectFactoryValue(name string) {
+	if af.pkg == nil {
+		return
+	}
+	scope := af.pkg.Types.Scope()
+	v, ok := scope.Lookup(name).(*types.Var)
+	if !ok {
+		return
+	}
+	t := v.Type()
+	named, _ := t.(*types.Named)
+	if ptr, ok := t.(*types.Pointer); ok {
+		named, _ = ptr.Elem().(*types.Named)
+	}
+	if named == nil || named.Obj().Pkg() != af.pkg.Types || !af.analyzer.hasCtorMethod(named, t) {
+		return
+	}
+	if _, ok := af.packageCtor(named.Obj().Name()); ok {
+		af.analyzer.debugf("%s: Not supplying %s -- %s has a constructor", af.relPath, name, named.Obj().Name())
+		return
+	}
+	// fx.Supply() of two values of the same type fails, so it is up to the
+	// user to choose.
+	for _, other := range scope.Names() {
+		if o, ok := scope.Lookup(other).(*types.Var); ok && other != name && types.Identical(o.Type(), t) {
+			af.analyzer.debugf("%s: Not supplying %s -- %s holds a %s as well", af.relPath, name, other, t)
+			return
+		}
+	}
+	af.analyzer.debugf("%s: Supplying factory %s", af.relPath, name)
+	af.suppliedVars = append(af.suppliedVars, name)
+}
+
+// Returns true if the type has a constructor method whose receiver is of
+// type recv, T or *T.
+func (a *Analyzer) hasCtorMethod(named *types.Named, recv types.Type) bool {
+	for i := 0; i < named.NumMethods(); i++ {
+		method := named.Method(i)
+		if !method.Exported() || !a.isCtorName(method.Name()) {
+			continue
+		}
+		sig := method.Type().(*types.Signature)
+		if sig.Results().Len() > 0 && types.Identical(sig.Recv().Type(), recv) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the function providing the result of the constructor method, taking
+// the factory as its first argument.
+func (af *analyzedFile) getMethodProvider(ctor *ctorInfo) *dst.FuncDecl {
+	recv := ctor.decl.Recv.List[0]
+	params := &dst.FieldList{List: append([]*dst.Field{{Names: recv.Names, Type: recv.Type}}, ctor.decl.Type.Params.List...)}
+	params, args, variadic := forwardedParams(params)
+
+	// return f.NewClient(cfg)
+	call := &dst.CallExpr{
+		Fun:      &dst.SelectorExpr{X: args[0], Sel: &dst.Ident{Name: ctor.decl.Name.Name}},
+		Args:     args[1:],
+		Ellipsis: variadic,
+	}
+
+	results := &dst.FieldList{}
+	for _, result := range flattenFields(ctor.decl.Type.Results) {
+		results.List = append(results.List, &dst.Field{Type: dst.Clone(result).(dst.Expr)})
+	}
+
+	provider := &dst.FuncDecl{
+		Name: &dst.Ident{Name: ctor.provider},
+		Type: &dst.FuncType{
+			Func:    true,
+			Params:  params,
+			Results: results,
+		},
+		Body: &dst.BlockStmt{
+			List: []dst.Stmt{&dst.ReturnStmt{Results: []dst.Expr{call}}},
+		},
+	}
+	provider.Decs.Before = dst.EmptyLine
+	return provider
+}
@@ -0,0 +1,309 @@
+package fxforce5
+
+import (
+	"go/ast"
+	"go/build"
+	"go/build/constraint"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+// What is done with _test.go files, see WithTestFiles().
+type TestFilePolicy string
+
+const (
+	// Test files are left alone.
+	TEST_FILES_SKIP TestFilePolicy = "skip"
+	// Calls in test files to the rewritten constructors of the package they
+	// test are updated to call the original ones, renamed NewXOrig, which
+	// keep their signature.
+	TEST_FILES_UPDATE TestFilePolicy = "update"
+)
+
+// Returns the reason why the Go file at path is not analyzed, or "" if it
+// is. Files generated by tools (with the standard "Code generated ... DO NOT
+// EDIT." header) and files excluded by the ignore build tag are not
+// analyzed.
+//
+// Other files not in the current build, e.g. conn_windows.go on Linux, are
+// analyzed with the type information of the files of their package in the
+// build, so that platform-specific variants of a constructor are rewritten
+// the same way.
+func (a *Analyzer) skipReason(path string) (string, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, nil, parser.PackageClauseOnly|parser.ParseComments)
+	if err != nil {
+		return "", err
+	}
+	if ast.IsGenerated(file) {
+		return "generated", nil
+	}
+	for _, group := range file.Comments {
+		if group.Pos() > file.Package {
+			break
+		}
+		for _, comment := range group.List {
+			if !constraint.IsGoBuild(comment.Text) {
+				continue
+			}
+			expr, err := constraint.Parse(comment.Text)
+			if err != nil {
+				pos := fset.Position(comment.Pos())
+				pos.Filename = a.dirRelPath(path)
+				return "", &Diagnostic{Pos: pos, Severity: SEVERITY_ERROR, Code: DIAG_BUILD_CONSTRAINT, Message: err.Error()}
+			}
+			if !satisfiable(expr, map[string]bool{"ignore": false}) {
+				return "excluded by build constraint " + expr.String(), nil
+			}
+		}
+	}
+	match, err := a.buildContext().MatchFile(filepath.Dir(path), filepath.Base(path))
+	if err == nil && !match {
+		a.debugf("%s: Not in the current build, analyzing it with the type information of its package", a.relPath(path))
+	}
+	return "", nil
+}
+
+// Returns the build context the packages are loaded with.
+func (a *Analyzer) buildContext() *build.Context {
+	ctx := build.Default
+	ctx.BuildTags = a.buildTags
+	return &ctx
+}
+
+// GOOS and GOARCH values constraining the build of files named after them,
+// e.g. conn_linux.go, as listed by go tool dist list, and the unix tag.
+var platformTags = map[string]bool{
+	"aix": true, "android": true, "darwin": true, "dragonfly": true, "freebsd": true, "hurd": true,
+	"illumos": true, "ios": true, "js": true, "linux": true, "nacl": true, "netbsd": true,
+	"openbsd": true, "plan9": true, "solaris": true, "wasip1": true, "windows": true, "zos": true,
+	"386": true, "amd64": true, "amd64p32": true, "arm": true, "armbe": true, "arm64": true,
+	"arm64be": true, "loong64": true, "mips": true, "mipsle": true, "mips64": true, "mips64le": true,
+	"mips64p32": true, "mips64p32le": true, "ppc": true, "ppc64": true, "ppc64le": true,
+	"riscv": true, "riscv64": true, "s390": true, "s390x": true, "sparc": true, "sparc64": true,
+	"wasm": true, "unix": true,
+}
+
+// Returns the name of the file at path without its extension and the
+// suffixes constraining its build, so that the variants of a file for
+// different platforms or build tags share it: conn for conn_linux.go,
+// conn_darwin_arm64.go and conn_unix.go. Suffixes are GOOS and GOARCH values
+// and the build tags of the analyzer and of the build constraint of the
+// file. They are kept if another file of the package has the name without
+// them, e.g. conn.go.
+func (a *Analyzer) variantName(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), ".go")
+	tags := make(map[string]bool)
+	for _, tag := range a.buildTags {
+		tags[tag] = true
+	}
+	file, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.PackageClauseOnly|parser.ParseComments)
+	if err == nil {
+		for _, group := range file.Comments {
+			if group.Pos() > file.Package {
+				break
+			}
+			for _, comment := range group.List {
+				if expr, err := constraint.Parse(comment.Text); err == nil && constraint.IsGoBuild(comment.Text) {
+					expr.Eval(func(tag string) bool {
+						tags[tag] = true
+						return false
+					})
+				}
+			}
+		}
+	}
+	base := name
+	for i := strings.LastIndex(base, "_"); i > 0; i = strings.LastIndex(base, "_") {
+		if suffix := base[i+1:]; !platformTags[suffix] && !tags[suffix] {
+			break
+		}
+		base = base[:i]
+	}
+	if base == name {
+		return name
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(path), base+".go")); err == nil {
+		return name
+	}
+	return base
+}
+
+// Returns true if some values of the tags of the build constraint, other
+// than the fixed ones, satisfy it.
+func satisfiable(expr constraint.Expr, fixed map[string]bool) bool {
+	tags := make([]string, 0)
+	seen := make(map[string]bool)
+	expr.Eval(func(tag string) bool {
+		if _, ok := fixed[tag]; !ok && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+		return false
+	})
+	if len(tags) > 16 {
+		return true
+	}
+	for values := 0; values < 1<<len(tags); values++ {
+		ok := expr.Eval(func(tag string) bool {
+			if value, ok := fixed[tag]; ok {
+				return value
+			}
+			for i, t := range tags {
+				if t == tag {
+					return values&(1<<i) != 0
+				}
+			}
+			return false
+		})
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Update the test files according to the test file policy, once all other
+// files are rewritten.
+func (a *Analyzer) updateTestFiles() error {
+	if a.testPolicy != TEST_FILES_UPDATE {
+		if len(a.testFiles) > 0 {
+			a.infof("Not updating %d test files -- test file policy is %s", len(a.testFiles), a.testPolicy)
+		}
+		return nil
+	}
+	for _, path := range a.testFiles {
+		err := a.updateTestFile(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename the calls to the rewritten constructors of the tested package in
+// the test file to calls to the original constructors. The updated version
+// of x_test.go is written to x_new_test.go, so that it is still a test file.
+func (a *Analyzer) updateTestFile(path string) error {
+	fset := token.NewFileSet()
+	dstFile, err := decorator.ParseFile(fset, path, nil, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+	for _, s := range dstFile.Decs.Start.All() {
+		if s == PROCESSED_DIRECTIVE {
+			a.debugf("Skipping %s -- already processed", path)
+			return nil
+		}
+	}
+	pkgPath := a.importPath(filepath.Dir(path))
+
+	// Name the tested package is referred to by in external tests.
+	pkgName := ""
+	if strings.HasSuffix(dstFile.Name.Name, "_test") {
+		for _, spec := range dstFile.Imports {
+			if spec.Path.Value == `"`+pkgPath+`"` {
+				pkgName = strings.TrimSuffix(dstFile.Name.Name, "_test")
+				if spec.Name != nil {
+					pkgName = spec.Name.Name
+				}
+			}
+		}
+		if pkgName == "" {
+			return nil
+		}
+	}
+	declared := make(map[string]bool)
+	for _, decl := range dstFile.Decls {
+		if fn, ok := decl.(*dst.FuncDecl); ok && fn.Recv == nil {
+			declared[fn.Name.Name] = true
+		}
+	}
+
+	renamed := 0
+	rename := func(ident *dst.Ident) {
+		if a.rewrittenCtors[pkgPath+"."+ident.Name] && !declared[ident.Name] {
+			ident.Name += "Orig"
+			renamed++
+		}
+	}
+	selectors := make(map[*dst.Ident]bool)
+	dst.Inspect(dstFile, func(n dst.Node) bool {
+		switch n := n.(type) {
+		case *dst.SelectorExpr:
+			selectors[n.Sel] = true
+			if x, ok := n.X.(*dst.Ident); ok && pkgName != "" && x.Name == pkgName {
+				rename(n.Sel)
+			}
+		case *dst.Ident:
+			if pkgName == "" && !selectors[n] {
+				rename(n)
+			}
+		case *dst.FuncDecl:
+			selectors[n.Name] = true
+		}
+		return true
+	})
+	if renamed == 0 {
+		a.debugf("No changes for %s", path)
+		return nil
+	}
+	a.infof("%s: Renamed %d calls to rewritten constructors", a.relPath(path), renamed)
+	dstFile.Decs.Start.Prepend(PROCESSED_DIRECTIVE)
+	return a.writeFile(newPath(path), dstFile)
+}
+
+// Returns true if the file is the rewritten version of another file, see
+// newPath().
+func isRewrittenFile(path string) bool {
+	return strings.HasSuffix(path, "_new.go") || strings.HasSuffix(path, "_new_test.go")
+}
+
+// Returns the overlay replacing the rewritten files of the modules with
+// files declaring nothing, so that, until they replace the original ones,
+// their declarations do not clash with those of the original ones and the
+// packages can be type-checked.
+func (a *Analyzer) rewrittenOverlay() (map[string][]byte, error) {
+	overlay := make(map[string][]byte)
+	for _, m := range a.modules {
+		err := filepath.Walk(m.root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			name := info.Name()
+			if info.IsDir() {
+				if path != m.root && (strings.HasPrefix(name, ".") || name == "vendor" || name == "testdata") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !strings.HasSuffix(name, "_new.go") {
+				return nil
+			}
+			file, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.PackageClauseOnly)
+			if err != nil {
+				return nil
+			}
+			overlay[path] = []byte("package " + file.Name.Name + "\n")
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return overlay, nil
+}
+
+// Returns the path the rewritten version of the file is written to.
+func newPath(path string) string {
+	if strings.HasSuffix(path, "_test.go") {
+		return strings.TrimSuffix(path, "_test.go") + "_new_test.go"
+	}
+	return strings.TrimSuffix(path, ".go") + "_new.go"
+}
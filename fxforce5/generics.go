@@ -0,0 +1,220 @@
+package fxforce5
+
+import (
+	"go/types"
+	"sort"
+	"strings"
+
+	"github.com/dave/dst"
+	"golang.org/x/tools/go/packages"
+)
+
+// Generic constructors, such as
+//
+//	func NewCache[K comparable, V any](size int) *Cache[K, V]
+//
+// cannot be provided as they are: fx needs functions of concrete types. They
+// are provided once for each instantiation found in the module, of the
+// constructor (NewCache[string, int](10)) or of its result type (a field of
+// type *Cache[string, int]):
+//
+//	fx.Provide(NewCache[string, int])
+//
+// They are not rewritten, as the params struct would have to be generic as
+// well. Finding instantiations needs type information.
+
+// Collect the provider of each instantiation of the generic constructor in
+// pass 1.
+func (af *analyzedFile) inspectGenericCtor(decl *dst.FuncDecl, d directives) {
+	name := decl.Name.Name
+	if af.pkg == nil {
+		af.skip(name, "no type information to find its instantiations")
+		return
+	}
+	fn, ok := af.pkg.Types.Scope().Lookup(name).(*types.Func)
+	if !ok {
+		return
+	}
+	instances := af.analyzer.ctorInstances(fn)
+	if len(instances) == 0 {
+		af.skip(name, "no instantiations of it or of its result type found in the module")
+		return
+	}
+	for _, typeArgs := range instances {
+		ctor := af.newCtorInfo(name, decl.Type)
+		if ctor == nil {
+			return
+		}
+		args := make([]string, len(typeArgs))
+		for i, t := range typeArgs {
+			args[i] = af.typeString(t)
+		}
+		ctor.decl = decl
+		ctor.provider = name + "[" + strings.Join(args, ", ") + "]"
+		af.analyzer.debugf("%s: Providing %s", af.relPath, ctor.provider)
+		af.applyCtorDirectives(ctor, d)
+		af.addCtorCandidate(ctor)
+	}
+}
+
+// Returns the type arguments of the instantiations of the generic
+// constructor used in the module, sorted, without duplicates. Instantiations
+// of the result type count as well when its type arguments are exactly the
+// type parameters of the constructor.
+func (a *Analyzer) ctorInstances(fn *types.Func) [][]types.Type {
+	sig := fn.Type().(*types.Signature)
+	tparams := sig.TypeParams()
+
+	// For each type argument of the result type, the index of the type
+	// parameter of the constructor it is.
+	var result *types.Named
+	var resultOrder []int
+	if sig.Results().Len() > 0 {
+		t := sig.Results().At(0).Type()
+		if ptr, ok := t.(*types.Pointer); ok {
+			t = ptr.Elem()
+		}
+		result, _ = t.(*types.Named)
+	}
+	if result != nil && result.TypeArgs().Len() == tparams.Len() {
+		resultOrder = make([]int, tparams.Len())
+		for i := 0; i < tparams.Len() && resultOrder != nil; i++ {
+			resultOrder[i] = -1
+			for j := 0; j < tparams.Len(); j++ {
+				if result.TypeArgs().At(i) == tparams.At(j) {
+					resultOrder[i] = j
+				}
+			}
+			if resultOrder[i] < 0 {
+				resultOrder = nil
+			}
+		}
+	}
+
+	instances := make(map[string][]types.Type)
+	for _, pkg := range a.packages {
+		if pkg.TypesInfo == nil {
+			continue
+		}
+		for ident, inst := range pkg.TypesInfo.Instances {
+			obj := pkg.TypesInfo.Uses[ident]
+			var typeArgs []types.Type
+			switch {
+			case sameObject(obj, fn):
+				for i := 0; i < inst.TypeArgs.Len(); i++ {
+					typeArgs = append(typeArgs, inst.TypeArgs.At(i))
+				}
+			case resultOrder != nil && sameObject(obj, result.Obj()) && inst.TypeArgs.Len() == len(resultOrder):
+				typeArgs = make([]types.Type, len(resultOrder))
+				for i, j := range resultOrder {
+					typeArgs[j] = inst.TypeArgs.At(i)
+				}
+			default:
+				continue
+			}
+			if !a.instantiable(fn.Pkg().Path(), typeArgs) {
+				continue
+			}
+			if _, err := types.Instantiate(nil, sig, typeArgs, true); err != nil {
+				continue
+			}
+			key := ""
+			for _, t := range typeArgs {
+				key += types.TypeString(t, nil) + ","
+			}
+			instances[key] = typeArgs
+		}
+	}
+
+	keys := make([]string, 0, len(instances))
+	for key := range instances {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	retval := make([][]types.Type, len(keys))
+	for i, key := range keys {
+		retval[i] = instances[key]
+	}
+	return retval
+}
+
+// Returns true if both objects are the same declaration, even if they come
+// from different type checks of its package.
+func sameObject(obj types.Object, other types.Object) bool {
+	return obj != nil && obj.Pkg() != nil && other.Pkg() != nil &&
+		obj.Pkg().Path() == other.Pkg().Path() && obj.Name() == other.Name()
+}
+
+// Returns true if the type arguments can be written in the package at
+// pkgPath: they do not involve type parameters, and the types they refer to
+// are exported and from packages it can import.
+func (a *Analyzer) instantiable(pkgPath string, typeArgs []types.Type) bool {
+	for _, t := range typeArgs {
+		if !a.instantiableType(pkgPath, t) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *Analyzer) instantiableType(pkgPath string, t types.Type) bool {
+	switch t := t.(type) {
+	case *types.TypeParam:
+		return false
+	case *types.Basic:
+		return true
+	case *types.Pointer:
+		return a.instantiableType(pkgPath, t.Elem())
+	case *types.Slice:
+		return a.instantiableType(pkgPath, t.Elem())
+	case *types.Array:
+		return a.instantiableType(pkgPath, t.Elem())
+	case *types.Chan:
+		return a.instantiableType(pkgPath, t.Elem())
+	case *types.Map:
+		return a.instantiableType(pkgPath, t.Key()) && a.instantiableType(pkgPath, t.Elem())
+	case *types.Named:
+		obj := t.Obj()
+		if obj.Pkg() != nil && obj.Pkg().Path() != pkgPath {
+			if !obj.Exported() || a.dependsOn(obj.Pkg().Path(), pkgPath) {
+				return false
+			}
+		}
+		for i := 0; i < t.TypeArgs().Len(); i++ {
+			if !a.instantiableType(pkgPath, t.TypeArgs().At(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	// any
+	ifc, ok := t.Underlying().(*types.Interface)
+	return ok && ifc.Empty()
+}
+
+// Returns true if the package of the module at from imports the package at
+// to, directly or not, so that to cannot import from.
+func (a *Analyzer) dependsOn(from string, to string) bool {
+	byPath := make(map[string]*packages.Package)
+	for _, pkg := range a.packages {
+		byPath[pkg.PkgPath] = pkg
+	}
+	visited := make(map[string]bool)
+	var visit func(path string) bool
+	visit = func(path string) bool {
+		if path == to {
+			return true
+		}
+		if visited[path] || byPath[path] == nil {
+			return false
+		}
+		visited[path] = true
+		for imported := range byPath[path].Imports {
+			if visit(imported) {
+				return true
+			}
+		}
+		return false
+	}
+	return visit(from)
+}
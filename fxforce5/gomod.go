@@ -0,0 +1,303 @@
+package fxforce5
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+const (
+	// Module providing go.uber.org/fx.
+	UBER_FX_MODULE = "go.uber.org/fx"
+	// Version of go.uber.org/fx required by default, see WithFxVersion().
+	DEFAULT_FX_VERSION = "v1.20.1"
+	// Module providing the diutils package when it is not local, see
+	// WithDiutilsVersion().
+	FXFORCE5_MODULE = "github.com/debedb/fxforce5"
+)
+
+// Add the requirements of the rewritten code to the go.mod files of the
+// modules having rewritten files: go.uber.org/fx, and the fxforce5 module
+// when diutils is not local. Existing requirements are left alone.
+//
+// This does not go to the network: the indirect requirements and the go.sum
+// lines are computed from the local module cache as go mod tidy would (see
+// modgraph.go), when the modules are there. Otherwise a warning says to run
+// go mod tidy.
+func (a *Analyzer) updateGoMods() error {
+	if !a.applies(TRANSFORM_GO_MOD) {
+		return nil
+	}
+	requires := []module.Version{{Path: UBER_FX_MODULE, Version: a.fxVersion}}
+	// Packages imported by the rewritten code from the modules required.
+	pkgs := []string{UBER_FX_MODULE}
+	if !a.diutilsLocal() {
+		if a.diutilsVersion == "" {
+			a.debugf("No version of %s given, not requiring it", FXFORCE5_MODULE)
+		} else {
+			requires = append(requires, module.Version{Path: FXFORCE5_MODULE, Version: a.diutilsVersion})
+			diutilsImportPath, _ := strconv.Unquote(DIUTILS_IMPORT)
+			pkgs = append(pkgs, diutilsImportPath)
+		}
+	}
+	for _, m := range a.modules {
+		if !m.rewritten {
+			continue
+		}
+		err := a.updateGoMod(m, requires, pkgs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Analyzer) updateGoMod(m *goModule, requires []module.Version, pkgs []string) error {
+	goModFile := filepath.Join(m.root, "go.mod")
+	goModBuf, err := os.ReadFile(goModFile)
+	if err != nil {
+		return err
+	}
+	modFile, err := modfile.Parse(goModFile, goModBuf, nil)
+	if err != nil {
+		return err
+	}
+
+	added := make([]module.Version, 0)
+	for _, req := range requires {
+		if req.Path == m.path {
+			continue
+		}
+		if existing := requiredVersion(modFile, req.Path); existing != "" {
+			if semver.Compare(existing, req.Version) < 0 {
+				a.infof("%s: keeping %s %s, older than %s", goModFile, req.Path, existing, req.Version)
+			}
+			continue
+		}
+		a.infof("%s: adding require %s %s", goModFile, req.Path, req.Version)
+		added = append(added, req)
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	// The modules providing the packages imported, transitively, are
+	// required too. Requiring them may select higher versions of other
+	// modules, so this goes on until the requirements do not change.
+	pruned := goAtLeast(modFile, "1.17")
+	indirect := make([]module.Version, 0)
+	var graph *moduleGraph
+	for {
+		graph = loadModuleGraph(append(append([]module.Version{}, added...), indirect...), pruned)
+		next := make([]module.Version, 0)
+		for _, mod := range graph.importedModules(pkgs) {
+			if mod.Path == m.path || requiredVersion(modFile, mod.Path) != "" || isRequired(added, mod.Path) {
+				continue
+			}
+			next = append(next, mod)
+		}
+		for _, mod := range indirect {
+			if !isRequired(next, mod.Path) {
+				next = append(next, mod)
+			}
+		}
+		sort.Slice(next, func(i, j int) bool {
+			return next[i].Path < next[j].Path
+		})
+		if len(next) == len(indirect) && sameVersions(next, indirect) {
+			break
+		}
+		indirect = next
+	}
+	missing := make([]string, 0)
+	for mod := range graph.missing {
+		missing = append(missing, mod.Path+" "+mod.Version)
+	}
+	sort.Strings(missing)
+	for _, mod := range missing {
+		a.warnf("%s is not in the module cache, run go mod tidy", mod)
+	}
+
+	reqs := append([]*modfile.Require{}, modFile.Require...)
+	for _, req := range added {
+		reqs = append(reqs, &modfile.Require{Mod: req})
+	}
+	if pruned {
+		// Since go 1.17, go.mod lists all the modules providing packages
+		// to the build.
+		for _, mod := range indirect {
+			a.debugf("%s: adding require %s %s // indirect", goModFile, mod.Path, mod.Version)
+			reqs = append(reqs, &modfile.Require{Mod: mod, Indirect: true})
+		}
+	}
+	modFile.SetRequireSeparateIndirect(reqs)
+	modFile.Cleanup()
+	goModBuf, err = modFile.Format()
+	if err != nil {
+		return err
+	}
+	err = a.writeOutput(goModFile, goModBuf)
+	if err != nil {
+		return err
+	}
+
+	// The content of the modules built, and the go.mod files of the module
+	// graph.
+	sums := make([]string, 0)
+	for _, mod := range append(added, indirect...) {
+		if zipHash, ok := cachedFile(mod, ".ziphash"); ok {
+			sums = append(sums, mod.Path+" "+mod.Version+" "+strings.TrimSpace(string(zipHash)))
+		}
+	}
+	for mod, modBuf := range graph.loaded {
+		sums = append(sums, goModSum(mod, modBuf)...)
+	}
+	return a.addGoSums(filepath.Join(m.root, "go.sum"), sums)
+}
+
+// Returns true if the module is in the list.
+func isRequired(mods []module.Version, path string) bool {
+	for _, mod := range mods {
+		if mod.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the lists of modules, of the same length, are the same.
+func sameVersions(mods []module.Version, other []module.Version) bool {
+	for i := range mods {
+		if mods[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the version of the module required by the go.mod file, or "".
+func requiredVersion(modFile *modfile.File, path string) string {
+	for _, req := range modFile.Require {
+		if req.Mod.Path == path {
+			return req.Mod.Version
+		}
+	}
+	return ""
+}
+
+// Returns the directory of the module cache holding the downloads of the
+// module.
+func moduleCacheDir(path string) (string, error) {
+	escaped, err := module.EscapePath(path)
+	if err != nil {
+		return "", err
+	}
+	cache, err := moduleCache()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cache, "cache", "download", escaped, "@v"), nil
+}
+
+// Returns the directory of the module cache holding the extracted sources
+// of the module version.
+func moduleSourceDir(mod module.Version) (string, error) {
+	escaped, err := module.EscapePath(mod.Path)
+	if err != nil {
+		return "", err
+	}
+	version, err := module.EscapeVersion(mod.Version)
+	if err != nil {
+		return "", err
+	}
+	cache, err := moduleCache()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cache, escaped+"@"+version), nil
+}
+
+// Returns the module cache directory, as go env GOMODCACHE would.
+func moduleCache() (string, error) {
+	cache := os.Getenv("GOMODCACHE")
+	if cache == "" {
+		gopath := os.Getenv("GOPATH")
+		if gopath == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", err
+			}
+			gopath = filepath.Join(home, "go")
+		}
+		cache = filepath.Join(filepath.SplitList(gopath)[0], "pkg", "mod")
+	}
+	return cache, nil
+}
+
+// Returns the go.sum line of the go.mod file of the module.
+func goModSum(mod module.Version, modBuf []byte) []string {
+	hash, err := dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(modBuf)), nil
+	})
+	if err != nil {
+		return nil
+	}
+	return []string{mod.Path + " " + mod.Version + "/go.mod " + hash}
+}
+
+// Returns the content of the file of the module version in the module
+// cache with the given extension.
+func cachedFile(mod module.Version, ext string) ([]byte, bool) {
+	dir, err := moduleCacheDir(mod.Path)
+	if err != nil {
+		return nil, false
+	}
+	version, err := module.EscapeVersion(mod.Version)
+	if err != nil {
+		return nil, false
+	}
+	buf, err := os.ReadFile(filepath.Join(dir, version+ext))
+	return buf, err == nil
+}
+
+// Add the lines missing from the go.sum file, keeping it sorted.
+func (a *Analyzer) addGoSums(goSumFile string, sums []string) error {
+	lines := make(map[string]bool)
+	buf, err := os.ReadFile(goSumFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines[line] = true
+		}
+	}
+	changed := false
+	for _, sum := range sums {
+		if !lines[sum] {
+			lines[sum] = true
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	sorted := make([]string, 0, len(lines))
+	for line := range lines {
+		sorted = append(sorted, line)
+	}
+	sort.Strings(sorted)
+	a.infof("Updating %s", goSumFile)
+	return a.writeOutput(goSumFile, []byte(strings.Join(sorted, "\n")+"\n"))
+}
@@ -0,0 +1,121 @@
+package fxforce5
+
+import (
+	"fmt"
+	"go/types"
+	"strings"
+)
+
+// GroupRule puts the providers of all types implementing an interface into
+// a value group, e.g. all http handlers implementing Route into "routes".
+// Such providers are registered as
+//
+//	fx.Provide(fx.Annotate(NewHandler, fx.As(new(Route)), fx.ResultTags(`group:"routes"`)))
+//
+// and params fields of type []Route are tagged `group:"routes"` so that
+// consumers get all of them.
+type GroupRule struct {
+	// Name of the interface, either qualified by import path
+	// ("example.com/x/http.Route") or not ("Route").
+	Interface string
+	// Name of the value group.
+	Group string
+}
+
+// ParseGroupRule parses a rule in the Interface=group form used on the
+// command line.
+func ParseGroupRule(s string) (GroupRule, error) {
+	ifc, group, ok := strings.Cut(s, "=")
+	if !ok || ifc == "" || group == "" {
+		return GroupRule{}, fmt.Errorf("malformed group rule %q, expected Interface=group", s)
+	}
+	return GroupRule{Interface: ifc, Group: group}, nil
+}
+
+func (r GroupRule) String() string {
+	return r.Interface + "=" + r.Group
+}
+
+// Returns the interface of the rule, or nil if there is no such interface
+// in the module.
+func (a *Analyzer) groupInterface(rule GroupRule, af *analyzedFile) (*types.Named, *types.Interface) {
+	named := a.lookupNamed(rule.Interface, af.pkg)
+	if named == nil {
+		return nil, nil
+	}
+	ifc, ok := named.Underlying().(*types.Interface)
+	if !ok {
+		a.warnf("Ignoring group rule %s -- %s is not an interface", rule, rule.Interface)
+		return nil, nil
+	}
+	return named, ifc
+}
+
+// Apply the group rules to the constructors of the file: constructors of
+// types implementing a rule's interface are annotated with the group. Runs
+// between the two passes.
+func (a *Analyzer) applyGroupRules(af *analyzedFile) {
+	if len(a.groupRules) == 0 || !a.applies(TRANSFORM_GROUPS) {
+		return
+	}
+	if af.pkg == nil {
+		a.warnf("No type information for %s, not applying group rules", af.relPath)
+		return
+	}
+	for _, rule := range a.groupRules {
+		named, ifc := a.groupInterface(rule, af)
+		if named == nil {
+			continue
+		}
+		for _, key := range af.ctorKeys() {
+			ctor := af.ctors[key]
+			if ctor.group != "" || ctor.returnInfo.returnKind == multiKind {
+				continue
+			}
+			result := af.localNamed(ctor.returnInfo.name)
+			if result == nil {
+				continue
+			}
+			if types.Identical(result, named) {
+				a.debugf("%s: %s provides %s into group %s", af.relPath, ctor.providerName(), rule.Interface, rule.Group)
+				ctor.group = rule.Group
+				continue
+			}
+			var t types.Type = result
+			if ctor.returnInfo.ptr {
+				t = types.NewPointer(result)
+			}
+			if types.Implements(t, ifc) {
+				a.debugf("%s: %s provides %s as %s into group %s", af.relPath, ctor.providerName(), t, rule.Interface, rule.Group)
+				ctor.group = rule.Group
+				ctor.as = append(ctor.as, af.typeExpr(named))
+			}
+		}
+		af.groupSlices = append(af.groupSlices, groupSlice{elem: named, group: rule.Group})
+	}
+}
+
+// A slice type whose values come from a value group.
+type groupSlice struct {
+	elem  *types.Named
+	group string
+}
+
+// Returns the group feeding the field of the local struct if it is a slice
+// of a grouped interface, or "".
+func (af *analyzedFile) fieldGroup(structName string, fieldName string) string {
+	t := af.localFieldType(structName, fieldName)
+	if t == nil {
+		return ""
+	}
+	slice, ok := t.(*types.Slice)
+	if !ok {
+		return ""
+	}
+	for _, gs := range af.groupSlices {
+		if types.Identical(slice.Elem(), gs.elem) {
+			return gs.group
+		}
+	}
+	return ""
+}
@@ -0,0 +1,246 @@
+package fxforce5
+
+import (
+	"go/token"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+// An import to add to the file.
+type newImport struct {
+	path string
+	// Name the package is imported as; the import is aliased if it is not
+	// the last element of the path.
+	name string
+}
+
+// Returns the name under which the package is imported in the file,
+// adding the import if it is not there yet. The import is aliased if name
+// is taken in the file, e.g. by a declaration or another import.
+func (af *analyzedFile) importName(path string, name string) string {
+	if existing, ok := af.imports[path]; ok && existing != "_" && existing != "." {
+		return existing
+	}
+	if af.imports == nil {
+		af.imports = make(map[string]string)
+	}
+	unique := name
+	for i := 2; af.isNameTaken(unique); i++ {
+		unique = name + strconv.Itoa(i)
+	}
+	if unique != name {
+		af.analyzer.debugf("%s: Importing %s as %s -- %s is taken", af.relPath, path, unique, name)
+	}
+	af.imports[path] = unique
+	af.newImports = append(af.newImports, newImport{path: path, name: unique})
+	return unique
+}
+
+// Returns the name the import spec makes the package available under.
+func (af *analyzedFile) importedName(spec *dst.ImportSpec, path string) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	if af.pkg != nil && af.pkg.Imports[path] != nil {
+		return af.pkg.Imports[path].Name
+	}
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+// Returns true if the name cannot be used for a new import: it is the name
+// of another import, of a package-level declaration, or of any identifier of
+// the file, which a new import could be shadowed by.
+func (af *analyzedFile) isNameTaken(name string) bool {
+	for _, imported := range af.imports {
+		if imported == name {
+			return true
+		}
+	}
+	if af.pkg != nil && af.pkg.Types.Scope().Lookup(name) != nil {
+		return true
+	}
+	taken := false
+	dst.Inspect(af.dstFile, func(n dst.Node) bool {
+		if ident, ok := n.(*dst.Ident); ok && ident.Name == name {
+			taken = true
+		}
+		return !taken
+	})
+	return taken
+}
+
+// Choose the names fx, and diutils if rewritten constructors need it, are
+// referred to by, importing them if needed. Runs before the rewrites of
+// pass 2 using these names.
+func (af *analyzedFile) resolveImportNames() {
+	af.fxName = af.importName(UBER_FX_MODULE, "fx")
+	for _, ctor := range af.ctors {
+		if ctor.rewritten() {
+			af.diutilsName = af.importName(af.diutilsImportPath, "diutils")
+			break
+		}
+	}
+}
+
+// Returns true if the import path is of the standard library, i.e. its
+// first element has no dot, like goimports does.
+func isStdImport(importPath string) bool {
+	return !strings.Contains(strings.Split(importPath, "/")[0], ".")
+}
+
+// Returns the import path of the spec, or "" if it is invalid.
+func importSpecPath(spec dst.Spec) string {
+	importSpec, ok := spec.(*dst.ImportSpec)
+	if !ok {
+		return ""
+	}
+	importPath, _ := strconv.Unquote(importSpec.Path.Value)
+	return importPath
+}
+
+// Add the new imports to the first import declaration of the file, creating
+// it if needed, keeping its layout like goimports would: standard library
+// imports go to the first group having standard library imports, others to
+// the group having the other imports sharing the longest prefix with them.
+// New groups are added first for the standard library, last for others.
+// Imports are inserted in order in groups that are sorted.
+func (af *analyzedFile) addImports() {
+	if len(af.newImports) == 0 {
+		return
+	}
+	var decl *dst.GenDecl
+	for _, d := range af.dstFile.Decls {
+		if genDecl, ok := d.(*dst.GenDecl); ok && genDecl.Tok == token.IMPORT {
+			decl = genDecl
+			break
+		}
+	}
+	if decl == nil {
+		decl = &dst.GenDecl{Tok: token.IMPORT}
+		decl.Decs.Before = dst.EmptyLine
+		decl.Decs.After = dst.EmptyLine
+		af.dstFile.Decls = append([]dst.Decl{decl}, af.dstFile.Decls...)
+	}
+
+	// Split into groups separated by empty lines.
+	groups := make([][]dst.Spec, 0)
+	for i, spec := range decl.Specs {
+		if i == 0 || spec.Decorations().Before == dst.EmptyLine {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], spec)
+	}
+
+	for _, imp := range af.newImports {
+		spec := &dst.ImportSpec{Path: &dst.BasicLit{Kind: token.STRING, Value: strconv.Quote(imp.path)}}
+		if imp.name != path.Base(imp.path) {
+			spec.Name = &dst.Ident{Name: imp.name}
+		}
+		std := isStdImport(imp.path)
+		best, bestLen := -1, -1
+		for i, group := range groups {
+			for _, other := range group {
+				otherPath := importSpecPath(other)
+				if isStdImport(otherPath) != std {
+					continue
+				}
+				if l := commonPrefixLen(imp.path, otherPath); l > bestLen {
+					best, bestLen = i, l
+				}
+			}
+			if std && best >= 0 {
+				break
+			}
+		}
+		switch {
+		case best >= 0:
+			groups[best] = insertImportSpec(groups[best], spec)
+		case std:
+			groups = append([][]dst.Spec{{spec}}, groups...)
+		default:
+			groups = append(groups, []dst.Spec{spec})
+		}
+	}
+	af.newImports = nil
+
+	specs := make([]dst.Spec, 0)
+	for i, group := range groups {
+		for j, spec := range group {
+			// The spec of a single import, e.g. import "fmt", is followed
+			// by an empty line.
+			spec.Decorations().After = dst.None
+			switch {
+			case j > 0:
+				spec.Decorations().Before = dst.NewLine
+			case i > 0:
+				spec.Decorations().Before = dst.EmptyLine
+			default:
+				spec.Decorations().Before = dst.NewLine
+			}
+			specs = append(specs, spec)
+		}
+	}
+	decl.Specs = specs
+	if len(specs) > 1 {
+		decl.Lparen = true
+		decl.Rparen = true
+	}
+}
+
+// Insert the spec into the group of imports, in order if the group is
+// sorted by path, last otherwise.
+func insertImportSpec(group []dst.Spec, spec *dst.ImportSpec) []dst.Spec {
+	paths := make([]string, len(group))
+	for i, other := range group {
+		paths[i] = importSpecPath(other)
+	}
+	i := len(group)
+	if sort.StringsAreSorted(paths) {
+		i = sort.SearchStrings(paths, importSpecPath(spec))
+	}
+	group = append(group, nil)
+	copy(group[i+1:], group[i:])
+	group[i] = spec
+	return group
+}
+
+// Returns the number of leading path elements both import paths share.
+func commonPrefixLen(importPath string, other string) int {
+	elems := strings.Split(importPath, "/")
+	otherElems := strings.Split(other, "/")
+	n := 0
+	for n < len(elems) && n < len(otherElems) && elems[n] == otherElems[n] {
+		n++
+	}
+	return n
+}
+
+// Add the fx.Module declaration after the imports, unless the file already
+// declares one.
+func (af *analyzedFile) addModuleVar() error {
+	if af.existingModuleVar != "" {
+		af.analyzer.debugf("Skipping adding fx.Module declaration to %s -- already exists as %+v", af.relPath, af.existingModuleVar)
+		return nil
+	}
+	node, err := decorator.NewDecorator(nil).DecorateNode(af.getFxModuleDecl())
+	if err != nil {
+		return err
+	}
+	dstDecl := node.(dst.Decl)
+	i := 0
+	for j, d := range af.dstFile.Decls {
+		if genDecl, ok := d.(*dst.GenDecl); ok && genDecl.Tok == token.IMPORT {
+			i = j + 1
+		}
+	}
+	dstDecl.Decorations().Before = dst.EmptyLine
+	af.dstFile.Decls = append(af.dstFile.Decls, nil)
+	copy(af.dstFile.Decls[i+1:], af.dstFile.Decls[i:])
+	af.dstFile.Decls[i] = dstDecl
+	return nil
+}
@@ -0,0 +1,212 @@
+package fxforce5
+
+import (
+	"go/token"
+	"go/types"
+
+	"github.com/dave/dst"
+)
+
+// Lifecycle hooks of a constructed type. Types with methods
+//
+//	Start(context.Context) error
+//	Stop(context.Context) error
+//	Close() error
+//
+// are started and stopped by fx: the params struct gets an fx.Lifecycle
+// field and the constructor appends an fx.Hook calling them.
+type lifecycleHooks struct {
+	start bool
+	stop  bool
+	// Close() is used on stop if there is no Stop().
+	close bool
+	// Name the context package is imported as, for the Close() wrapper.
+	contextPkg string
+	// Name of the params field holding the fx.Lifecycle
+	field string
+}
+
+// Detect the lifecycle methods of the types constructed in the file. Runs
+// between the two passes.
+func (a *Analyzer) applyLifecycle(af *analyzedFile) {
+	if !a.applies(TRANSFORM_LIFECYCLE) {
+		return
+	}
+	for _, key := range af.ctorKeys() {
+		ctor := af.structCtor(key)
+		if ctor == nil {
+			continue
+		}
+		hooks := af.lifecycleOf(key, ctor.returnInfo.ptr)
+		if hooks == nil {
+			continue
+		}
+		if hooks.close && !hooks.stop {
+			// Imports are added at the start of the second pass, so the
+			// context import needed for the Close() wrapper is added now.
+			hooks.contextPkg = af.importName("context", "context")
+		}
+		a.debugf("%s: %s has lifecycle methods, adding fx hooks to %s", af.relPath, key, ctor.providerName())
+		ctor.lifecycle = hooks
+	}
+}
+
+// Returns the lifecycle hooks of the local type (or pointer to it), or nil
+// if it has no lifecycle methods or there is no type information.
+func (af *analyzedFile) lifecycleOf(typeName string, ptr bool) *lifecycleHooks {
+	named := af.localNamed(typeName)
+	if named == nil {
+		return nil
+	}
+	var t types.Type = named
+	if ptr {
+		t = types.NewPointer(named)
+	}
+	mset := types.NewMethodSet(t)
+	hooks := &lifecycleHooks{
+		start: hasMethod(mset, "Start", true),
+		stop:  hasMethod(mset, "Stop", true),
+		close: hasMethod(mset, "Close", false),
+		field: "Lifecycle",
+	}
+	if !hooks.start && !hooks.stop && !hooks.close {
+		return nil
+	}
+	if af.paramsHasField(typeName, hooks.field) {
+		hooks.field = "FxLifecycle"
+	}
+	return hooks
+}
+
+// Returns the lifecycle hooks of the struct declared in the file, whether
+// its constructor is in this file or in another one.
+func (af *analyzedFile) structLifecycle(structName string) *lifecycleHooks {
+	if ctor := af.structCtor(structName); ctor != nil {
+		return ctor.lifecycle
+	}
+	if choice, ok := af.packageCtor(structName); ok && choice.name != "" && !choice.multi && af.analyzer.applies(TRANSFORM_LIFECYCLE) {
+		return af.lifecycleOf(structName, choice.ptr)
+	}
+	return nil
+}
+
+// Returns true if the method set has the method with the signature
+// func(context.Context) error (withCtx) or func() error.
+func hasMethod(mset *types.MethodSet, name string, withCtx bool) bool {
+	for i := 0; i < mset.Len(); i++ {
+		fn := mset.At(i).Obj()
+		if fn.Name() != name {
+			continue
+		}
+		sig := fn.Type().(*types.Signature)
+		if sig.Results().Len() != 1 || !isErrorTypesType(sig.Results().At(0).Type()) {
+			return false
+		}
+		if !withCtx {
+			return sig.Params().Len() == 0
+		}
+		if sig.Params().Len() != 1 {
+			return false
+		}
+		named, ok := sig.Params().At(0).Type().(*types.Named)
+		return ok && named.Obj().Pkg() != nil && named.Obj().Pkg().Path() == "context" && named.Obj().Name() == "Context"
+	}
+	return false
+}
+
+func isErrorTypesType(t types.Type) bool {
+	return types.Identical(t, types.Universe.Lookup("error").Type())
+}
+
+// Returns the params field receiving the fx.Lifecycle.
+func (hooks *lifecycleHooks) getParamField(fxName string) *dst.Field {
+	tag := structTag{}
+	tag.add(DIUTILS_TAG, "-")
+	return &dst.Field{
+		Names: []*dst.Ident{{Name: hooks.field}},
+		Type:  &dst.Ident{Name: fxName + ".Lifecycle"},
+		Tag:   tag.lit(),
+	}
+}
+
+// Returns the body of a constructor that calls constructCall and registers
+// the lifecycle hooks of the result:
+//
+//	retval := diutils.Construct[ServerParams, Server](params)
+//	params.Lifecycle.Append(fx.Hook{OnStart: retval.Start, OnStop: retval.Stop})
+//	return retval
+func (af *analyzedFile) getLifecycleBody(constructCall dst.Expr, ctor *ctorInfo) *dst.BlockStmt {
+	hooks := ctor.lifecycle
+	retval := func() *dst.Ident { return &dst.Ident{Name: "retval"} }
+	errIdent := func() *dst.Ident { return &dst.Ident{Name: "err"} }
+	method := func(name string) dst.Expr {
+		return &dst.SelectorExpr{X: retval(), Sel: &dst.Ident{Name: name}}
+	}
+
+	stmts := make([]dst.Stmt, 0)
+	assign := &dst.AssignStmt{
+		Lhs: []dst.Expr{retval()},
+		Tok: token.DEFINE,
+		Rhs: []dst.Expr{constructCall},
+	}
+	if ctor.constructErr {
+		assign.Lhs = append(assign.Lhs, errIdent())
+	}
+	stmts = append(stmts, assign)
+	if ctor.constructErr {
+		// On error, the construct functions return the zero value.
+		stmts = append(stmts, &dst.IfStmt{
+			Cond: &dst.BinaryExpr{X: errIdent(), Op: token.NEQ, Y: &dst.Ident{Name: "nil"}},
+			Body: &dst.BlockStmt{List: []dst.Stmt{
+				&dst.ReturnStmt{Results: []dst.Expr{retval(), errIdent()}},
+			}},
+		})
+	}
+
+	hookFields := make([]dst.Expr, 0)
+	if hooks.start {
+		hookFields = append(hookFields, &dst.KeyValueExpr{Key: &dst.Ident{Name: "OnStart"}, Value: method("Start")})
+	}
+	if hooks.stop {
+		hookFields = append(hookFields, &dst.KeyValueExpr{Key: &dst.Ident{Name: "OnStop"}, Value: method("Stop")})
+	} else if hooks.close {
+		// func(context.Context) error { return retval.Close() }
+		onStop := &dst.FuncLit{
+			Type: &dst.FuncType{
+				Func: true,
+				Params: &dst.FieldList{List: []*dst.Field{{
+					Type: &dst.SelectorExpr{X: &dst.Ident{Name: hooks.contextPkg}, Sel: &dst.Ident{Name: "Context"}},
+				}}},
+				Results: &dst.FieldList{List: []*dst.Field{{Type: &dst.Ident{Name: "error"}}}},
+			},
+			Body: &dst.BlockStmt{List: []dst.Stmt{
+				&dst.ReturnStmt{Results: []dst.Expr{&dst.CallExpr{Fun: method("Close")}}},
+			}},
+		}
+		hookFields = append(hookFields, &dst.KeyValueExpr{Key: &dst.Ident{Name: "OnStop"}, Value: onStop})
+	}
+	for _, hookField := range hookFields {
+		hookField.Decorations().Before = dst.NewLine
+		hookField.Decorations().After = dst.NewLine
+	}
+	stmts = append(stmts, &dst.ExprStmt{X: &dst.CallExpr{
+		Fun: &dst.SelectorExpr{
+			X: &dst.SelectorExpr{
+				X:   &dst.Ident{Name: "params"},
+				Sel: &dst.Ident{Name: hooks.field},
+			},
+			Sel: &dst.Ident{Name: "Append"},
+		},
+		Args: []dst.Expr{&dst.CompositeLit{
+			Type: &dst.SelectorExpr{X: &dst.Ident{Name: af.fxName}, Sel: &dst.Ident{Name: "Hook"}},
+			Elts: hookFields,
+		}},
+	}})
+
+	ret := &dst.ReturnStmt{Results: []dst.Expr{retval()}}
+	if ctor.constructErr {
+		ret.Results = append(ret.Results, &dst.Ident{Name: "nil"})
+	}
+	stmts = append(stmts, ret)
+	return &dst.BlockStmt{List: stmts}
+}
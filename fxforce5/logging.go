@@ -0,0 +1,41 @@
+package fxforce5
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// Messages are logged with the logger given with WithLogger(), slog.Default()
+// by default, at these levels:
+//
+//   - error: files that cannot be rewritten, see diagnostics.go;
+//   - warning: what is likely a mistake in the analyzed code or in the
+//     options, such as an unknown directive;
+//   - info: what is written, and the steps of the run;
+//   - debug: what is found and decided along the way, file by file.
+
+// Log the message at the level, formatted as with fmt.Sprintf(), if the
+// logger is enabled for it.
+func (a *Analyzer) logf(level slog.Level, format string, args ...interface{}) {
+	ctx := context.Background()
+	if a.logger.Enabled(ctx, level) {
+		a.logger.Log(ctx, level, fmt.Sprintf(format, args...))
+	}
+}
+
+func (a *Analyzer) debugf(format string, args ...interface{}) {
+	a.logf(slog.LevelDebug, format, args...)
+}
+
+func (a *Analyzer) infof(format string, args ...interface{}) {
+	a.logf(slog.LevelInfo, format, args...)
+}
+
+func (a *Analyzer) warnf(format string, args ...interface{}) {
+	a.logf(slog.LevelWarn, format, args...)
+}
+
+func (a *Analyzer) errorf(format string, args ...interface{}) {
+	a.logf(slog.LevelError, format, args...)
+}
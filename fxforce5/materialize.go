@@ -0,0 +1,107 @@
+package fxforce5
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/debedb/fxforce5/diutils"
+)
+
+const (
+	// Directory, relative to the module root, the diutils package is copied
+	// into by default, see WithDiutilsDir().
+	DEFAULT_DIUTILS_DIR = "diutils"
+
+	// First line of the copied diutils files.
+	DIUTILS_HEADER = "// Code generated by fxforce5 from " + FXFORCE5_MODULE + "/diutils. DO NOT EDIT."
+	// Prefix of the second line, followed by the SHA-256 of the rest of the
+	// file, to tell whether it was modified.
+	DIUTILS_HASH_PREFIX = "// fxforce5:sha256="
+)
+
+// Copy the diutils package embedded in fxforce5 into the modules having
+// rewritten files, when diutils is local. Files already there are updated
+// if the embedded version changed, unless they were modified.
+func (a *Analyzer) materializeDiutils() error {
+	if !a.diutilsLocal() {
+		return nil
+	}
+	for _, m := range a.modules {
+		if !m.rewritten {
+			continue
+		}
+		err := a.materializeDiutilsIn(filepath.Join(m.root, filepath.FromSlash(a.diutilsDir)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Analyzer) materializeDiutilsIn(dir string) error {
+	names, err := fs.Glob(diutils.Sources, "*.go")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == "embed.go" || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		src, err := diutils.Sources.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		err = a.writeDiutilsFile(filepath.Join(dir, name), src)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the copy of the diutils file at path, with the header, unless it is
+// up to date or was modified.
+func (a *Analyzer) writeDiutilsFile(path string, src []byte) error {
+	hash := sha256Hex(src)
+	existing, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		a.infof("Writing %s", path)
+	case err != nil:
+		return err
+	default:
+		existingHash, body, ok := parseDiutilsHeader(existing)
+		if !ok {
+			return fmt.Errorf("refusing to overwrite %s -- not written by fxforce5", path)
+		}
+		if existingHash != sha256Hex(body) {
+			return fmt.Errorf("refusing to overwrite %s -- modified since written by fxforce5", path)
+		}
+		if existingHash == hash {
+			return nil
+		}
+		a.infof("Updating %s", path)
+	}
+	header := DIUTILS_HEADER + "\n" + DIUTILS_HASH_PREFIX + hash + "\n\n"
+	return a.writeOutput(path, append([]byte(header), src...))
+}
+
+// Splits the copy of a diutils file into the hash in its header and the
+// rest. Returns false if it does not have the header.
+func parseDiutilsHeader(buf []byte) (string, []byte, bool) {
+	lines := strings.SplitN(string(buf), "\n", 4)
+	if len(lines) < 4 || lines[0] != DIUTILS_HEADER || !strings.HasPrefix(lines[1], DIUTILS_HASH_PREFIX) || lines[2] != "" {
+		return "", nil, false
+	}
+	return strings.TrimPrefix(lines[1], DIUTILS_HASH_PREFIX), []byte(lines[3]), true
+}
+
+func sha256Hex(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,225 @@
+package fxforce5
+
+import (
+	"go/types"
+	"path/filepath"
+	"sort"
+
+	"github.com/dave/dst"
+)
+
+// Model is what Load() found under the path, package by package: what the
+// rewrite would do, without doing it.
+type Model struct {
+	// Directory analyzed.
+	Dir      string          `json:"dir"`
+	Packages []*PackageModel `json:"packages"`
+	// See NamedDependencies().
+	NamedDependencies []NamedDependency `json:"namedDependencies"`
+}
+
+// PackageModel is what Load() found in a package. Paths are relative to the
+// analyzed directory.
+type PackageModel struct {
+	// Import path of the package.
+	Path         string             `json:"path"`
+	Dir          string             `json:"dir"`
+	Structs      []StructModel      `json:"structs"`
+	Constructors []ConstructorModel `json:"constructors"`
+	// Package vars holding factories, provided with fx.Supply().
+	Supplied    []string     `json:"supplied"`
+	Diagnostics []Diagnostic `json:"diagnostics"`
+}
+
+// StructModel is a struct declared in a package.
+type StructModel struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	// Name of its constructor, in any file of the package, "" if it has
+	// none.
+	Constructor string       `json:"constructor,omitempty"`
+	Fields      []FieldModel `json:"fields"`
+}
+
+// FieldModel is a field of a struct, and how it is injected if the struct
+// has a constructor.
+type FieldModel struct {
+	// "" for embedded fields.
+	Name string `json:"name,omitempty"`
+	// Type of the field relative to the package, "" without type
+	// information.
+	Type string `json:"type,omitempty"`
+	// Name the dependency is injected by, see NamedDependency.
+	Named string `json:"named,omitempty"`
+	// Value group injected, see GroupRule.
+	Group    string `json:"group,omitempty"`
+	Optional bool   `json:"optional,omitempty"`
+}
+
+// ConstructorModel is a constructor of a package, and how it is provided.
+type ConstructorModel struct {
+	// What is passed to fx.Provide(), see ConstructorReport.
+	Name string   `json:"name"`
+	File string   `json:"file"`
+	Kind CtorKind `json:"kind"`
+	// Local type constructed, if any.
+	Type string `json:"type,omitempty"`
+	// Whether it is replaced by a generated constructor, and whether it is
+	// provided in the fx.Module of its file.
+	Rewritten bool `json:"rewritten"`
+	Provided  bool `json:"provided"`
+	// Value group and name it is provided into or as, if any.
+	Group string `json:"group,omitempty"`
+	Named string `json:"named,omitempty"`
+	// Types it is provided as with fx.As().
+	As []string `json:"as,omitempty"`
+	// Lifecycle methods registered as fx hooks, e.g. Start.
+	Lifecycle []string `json:"lifecycle,omitempty"`
+}
+
+// Load analyzes the files under the path as Analyze() does, up to
+// rewriting them, and returns the model of what it found. Errors found in
+// files are in the diagnostics of their packages; an error is returned
+// only if the files cannot be analyzed at all.
+func (a *Analyzer) Load() (*Model, error) {
+	err := a.start()
+	if err != nil {
+		return nil, err
+	}
+	// The files with errors are dropped, see diagnostics.go, whether the
+	// run keeps going or not.
+	err = a.prepare()
+	if err != nil {
+		return nil, err
+	}
+	groups := a.fileGroups()
+	files, _ := a.inspectFiles(groups, make([]bool, len(groups)))
+
+	model := &Model{Dir: a.dir, Packages: make([]*PackageModel, 0, len(groups))}
+	// Keys of the named dependencies the fields are injected by.
+	named := make(map[string]bool)
+	for i := range groups {
+		dir := filepath.Dir(groups[i][0])
+		p := &PackageModel{
+			Path:         a.importPath(dir),
+			Dir:          a.dirRelPath(dir),
+			Structs:      []StructModel{},
+			Constructors: []ConstructorModel{},
+			Supplied:     []string{},
+			Diagnostics:  []Diagnostic{},
+		}
+		if r := a.reports[dir]; r != nil {
+			p.Diagnostics = append(p.Diagnostics, r.Diagnostics...)
+		}
+		for _, af := range files[i] {
+			if af != nil && !af.ignored {
+				af.addToModel(p, named)
+			}
+		}
+		model.Packages = append(model.Packages, p)
+	}
+	sort.Slice(model.Packages, func(i, j int) bool {
+		if model.Packages[i].Path != model.Packages[j].Path {
+			return model.Packages[i].Path < model.Packages[j].Path
+		}
+		return model.Packages[i].Dir < model.Packages[j].Dir
+	})
+	model.NamedDependencies = make([]NamedDependency, 0, len(named))
+	for key := range named {
+		model.NamedDependencies = append(model.NamedDependencies, a.namedDeps[key].NamedDependency)
+	}
+	sortNamedDependencies(model.NamedDependencies)
+	return model, nil
+}
+
+// Add the structs, constructors and supplied vars of the file to the model
+// of its package, and the keys of the named dependencies its fields are
+// injected by to named.
+func (af *analyzedFile) addToModel(p *PackageModel, named map[string]bool) {
+	rel := af.analyzer.dirRelPath(af.path)
+	for _, spec := range af.structTypes {
+		p.Structs = append(p.Structs, af.structModel(spec, rel, named))
+	}
+	provided := make(map[string]bool)
+	for _, key := range af.providerNames() {
+		provided[key] = true
+	}
+	for _, key := range af.ctorKeys() {
+		ctor := af.ctors[key]
+		m := ConstructorModel{
+			Name:      ctor.providerName(),
+			File:      rel,
+			Kind:      ctor.kind(),
+			Type:      ctor.returnInfo.name,
+			Rewritten: ctor.rewritten(),
+			Provided:  provided[key],
+			Group:     ctor.group,
+			Named:     ctor.name,
+			As:        ctor.as,
+		}
+		if hooks := ctor.lifecycle; hooks != nil {
+			for _, method := range []struct {
+				name string
+				has  bool
+			}{{"Start", hooks.start}, {"Stop", hooks.stop}, {"Close", hooks.close}} {
+				if method.has {
+					m.Lifecycle = append(m.Lifecycle, method.name)
+				}
+			}
+		}
+		p.Constructors = append(p.Constructors, m)
+	}
+	p.Supplied = append(p.Supplied, af.suppliedVars...)
+}
+
+// Returns the model of the struct declared in the file, adding the keys of
+// the named dependencies its fields are injected by to named.
+func (af *analyzedFile) structModel(spec *dst.TypeSpec, rel string, named map[string]bool) StructModel {
+	name := spec.Name.Name
+	m := StructModel{Name: name, File: rel, Fields: []FieldModel{}}
+	if ctor := af.structCtor(name); ctor != nil {
+		m.Constructor = ctor.providerName()
+	} else if choice, ok := af.packageCtor(name); ok {
+		m.Constructor = choice.name
+	}
+	// Whether the fields are injected, through a params struct.
+	injected := af.needsParamStruct(name)
+	// Fields of the type, in the order of the declaration, if known.
+	var st *types.Struct
+	if named := af.localNamed(name); named != nil {
+		st, _ = named.Underlying().(*types.Struct)
+	}
+	fieldType := func(i int) string {
+		if st == nil || i >= st.NumFields() {
+			return ""
+		}
+		return types.TypeString(st.Field(i).Type(), types.RelativeTo(af.pkg.Types))
+	}
+	for _, field := range spec.Type.(*dst.StructType).Fields.List {
+		if len(field.Names) == 0 {
+			m.Fields = append(m.Fields, FieldModel{Type: fieldType(len(m.Fields))})
+			continue
+		}
+		for _, ident := range field.Names {
+			f := FieldModel{Name: ident.Name, Type: fieldType(len(m.Fields))}
+			if !injected {
+				m.Fields = append(m.Fields, f)
+				continue
+			}
+			if depName := af.fieldDirectives(field).get(nameDirective); depName != "" {
+				f.Named = depName
+			} else if af.pkg != nil {
+				key := namedDepKey(af.pkg.PkgPath, name, ident.Name)
+				if dep := af.analyzer.namedDeps[key]; dep != nil {
+					named[key] = true
+					f.Named = dep.Name
+				}
+			}
+			if f.Group = af.fieldGroup(name, ident.Name); f.Group == "" {
+				f.Optional = af.analyzer.isOptionalField(af, name, field, ident.Name)
+			}
+			m.Fields = append(m.Fields, f)
+		}
+	}
+	return m
+}
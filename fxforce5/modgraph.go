@@ -0,0 +1,200 @@
+package fxforce5
+
+import (
+	"go/build/constraint"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// The requirements and go.sum lines added to a go.mod file along with
+// go.uber.org/fx are those go mod tidy would add, computed from the module
+// cache: the indirect requirements of the modules providing the packages
+// the rewritten code imports, transitively, and the go.sum lines of the
+// go.mod files the go command loads to build the module graph.
+
+// Module graph of a main module, loaded from the go.mod files in the module
+// cache.
+type moduleGraph struct {
+	// Whether the main module is at go 1.17 or later, see loadModuleGraph().
+	pruned bool
+	// Version of each module selected by minimal version selection, i.e.
+	// the highest one required.
+	selected map[string]string
+	// go.mod files loaded, by module version.
+	loaded map[module.Version][]byte
+	// Modules whose requirements are in the graph.
+	expanded map[module.Version]bool
+	// Modules not in the module cache.
+	missing map[module.Version]bool
+}
+
+// Load the module graph of a main module with the requirements, as the go
+// command does. The go.mod file of each module required is loaded, and its
+// requirements are in the graph. The requirements of modules at go 1.17 or
+// later are not loaded further (graph pruning), unless the main module is
+// before go 1.17.
+func loadModuleGraph(requires []module.Version, pruned bool) *moduleGraph {
+	g := &moduleGraph{
+		pruned:   pruned,
+		selected: make(map[string]string),
+		loaded:   make(map[module.Version][]byte),
+		expanded: make(map[module.Version]bool),
+		missing:  make(map[module.Version]bool),
+	}
+	for _, req := range requires {
+		g.visit(req)
+	}
+	return g
+}
+
+// Add the module and its requirements to the graph.
+func (g *moduleGraph) visit(mod module.Version) {
+	g.require(mod)
+	if g.expanded[mod] {
+		return
+	}
+	g.expanded[mod] = true
+	modFile := g.load(mod)
+	if modFile == nil {
+		return
+	}
+	prunedMod := g.pruned && goAtLeast(modFile, "1.17")
+	for _, req := range modFile.Require {
+		if prunedMod {
+			g.require(req.Mod)
+		} else {
+			g.visit(req.Mod)
+		}
+	}
+}
+
+// Select the version of the module if it is higher than the one selected.
+func (g *moduleGraph) require(mod module.Version) {
+	if semver.Compare(mod.Version, g.selected[mod.Path]) > 0 {
+		g.selected[mod.Path] = mod.Version
+	}
+}
+
+// Returns the go.mod file of the module, loading it from the module cache,
+// or nil if it is not there.
+func (g *moduleGraph) load(mod module.Version) *modfile.File {
+	buf, ok := cachedFile(mod, ".mod")
+	if !ok {
+		g.missing[mod] = true
+		return nil
+	}
+	g.loaded[mod] = buf
+	modFile, err := modfile.ParseLax("go.mod", buf, nil)
+	if err != nil {
+		return nil
+	}
+	return modFile
+}
+
+// Returns true if the go.mod file is at the go version or later.
+func goAtLeast(modFile *modfile.File, version string) bool {
+	return modFile.Go != nil && semver.Compare("v"+modFile.Go.Version, "v"+version) >= 0
+}
+
+// Returns the selected version of the module providing the package, or
+// false if no module of the graph does.
+func (g *moduleGraph) moduleOf(pkg string) (module.Version, bool) {
+	var mod module.Version
+	for path, version := range g.selected {
+		if (pkg == path || strings.HasPrefix(pkg, path+"/")) && len(path) > len(mod.Path) {
+			mod = module.Version{Path: path, Version: version}
+		}
+	}
+	return mod, mod.Path != ""
+}
+
+// Returns the modules of the graph providing the packages, and the packages
+// they import transitively, sorted by path. The packages are read from the
+// module cache, without their test files. Packages of modules whose sources
+// are not in the module cache are not followed; they are in g.missing.
+func (g *moduleGraph) importedModules(pkgs []string) []module.Version {
+	mods := make(map[module.Version]bool)
+	seen := make(map[string]bool)
+	for len(pkgs) > 0 {
+		pkg := pkgs[0]
+		pkgs = pkgs[1:]
+		if seen[pkg] || isStdImport(pkg) {
+			continue
+		}
+		seen[pkg] = true
+		mod, ok := g.moduleOf(pkg)
+		if !ok {
+			continue
+		}
+		mods[mod] = true
+		src, err := moduleSourceDir(mod)
+		if err != nil {
+			g.missing[mod] = true
+			continue
+		}
+		imports, err := packageImports(filepath.Join(src, filepath.FromSlash(strings.TrimPrefix(pkg, mod.Path))))
+		if err != nil {
+			g.missing[mod] = true
+			continue
+		}
+		pkgs = append(pkgs, imports...)
+	}
+	sorted := make([]module.Version, 0, len(mods))
+	for mod := range mods {
+		sorted = append(sorted, mod)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Path < sorted[j].Path
+	})
+	return sorted
+}
+
+// Returns the imports of the Go files of the package in dir, other than
+// test files and files excluded by the ignore build tag, as go mod tidy
+// considers all other build tags.
+func packageImports(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	imports := make([]string, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(token.NewFileSet(), filepath.Join(dir, name), nil, parser.ImportsOnly|parser.ParseComments)
+		if err != nil {
+			continue
+		}
+		ignored := false
+		for _, group := range file.Comments {
+			if group.Pos() > file.Package {
+				break
+			}
+			for _, comment := range group.List {
+				if expr, err := constraint.Parse(comment.Text); err == nil && constraint.IsGoBuild(comment.Text) {
+					ignored = ignored || !satisfiable(expr, map[string]bool{"ignore": false})
+				}
+			}
+		}
+		if ignored {
+			continue
+		}
+		for _, spec := range file.Imports {
+			if path, err := strconv.Unquote(spec.Path.Value); err == nil {
+				imports = append(imports, path)
+			}
+		}
+	}
+	return imports, nil
+}
@@ -0,0 +1,182 @@
+package fxforce5
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// A module of the analyzed code.
+type goModule struct {
+	// Root directory of the module, where its go.mod is.
+	root string
+	// Module path declared in go.mod.
+	path string
+	// Whether files of the module were rewritten, see updateGoMods().
+	rewritten bool
+}
+
+// Find the modules to analyze: the modules used by the go.work workspace
+// the directory is in, if any; otherwise the module the directory is in and
+// the modules nested in it. Like for the go command, GOWORK=off disables
+// workspaces and GOWORK=<file> selects one.
+func (a *Analyzer) findModules() error {
+	work, err := findWorkspace(a.dir)
+	if err != nil {
+		return err
+	}
+	roots := make([]string, 0)
+	if work != "" {
+		workBuf, err := os.ReadFile(work)
+		if err != nil {
+			return err
+		}
+		workFile, err := modfile.ParseWork(work, workBuf, nil)
+		if err != nil {
+			return err
+		}
+		a.infof("Found workspace %s", work)
+		for _, use := range workFile.Use {
+			root := use.Path
+			if !filepath.IsAbs(root) {
+				root = filepath.Join(filepath.Dir(work), root)
+			}
+			roots = append(roots, filepath.Clean(root))
+		}
+	} else {
+		root, err := findModuleRoot(a.dir)
+		if err != nil {
+			return err
+		}
+		roots = append(roots, root)
+		err = filepath.Walk(a.dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return err
+			}
+			name := info.Name()
+			if path != a.dir && (strings.HasPrefix(name, ".") || name == "vendor" || name == "testdata") {
+				return filepath.SkipDir
+			}
+			if path != root && isFile(filepath.Join(path, "go.mod")) {
+				roots = append(roots, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	a.modules = make([]*goModule, 0, len(roots))
+	for _, root := range roots {
+		goModFile := filepath.Join(root, "go.mod")
+		goModBuf, err := os.ReadFile(goModFile)
+		if err != nil {
+			return err
+		}
+		modFile, err := modfile.Parse(goModFile, goModBuf, nil)
+		if err != nil {
+			return err
+		}
+		a.infof("Found module %s in %s", modFile.Module.Mod.Path, root)
+		a.modules = append(a.modules, &goModule{root: root, path: modFile.Module.Mod.Path})
+	}
+	// Innermost modules first, see moduleOf().
+	sort.SliceStable(a.modules, func(i, j int) bool {
+		return len(a.modules[i].root) > len(a.modules[j].root)
+	})
+	return nil
+}
+
+// Returns the go.work file of the workspace dir is in, or "" if none.
+func findWorkspace(dir string) (string, error) {
+	switch gowork := os.Getenv("GOWORK"); gowork {
+	case "off":
+		return "", nil
+	case "":
+	default:
+		if !isFile(gowork) {
+			return "", fmt.Errorf("GOWORK file %s does not exist", gowork)
+		}
+		return filepath.Abs(gowork)
+	}
+	for d := dir; ; d = filepath.Dir(d) {
+		if isFile(filepath.Join(d, "go.work")) {
+			return filepath.Join(d, "go.work"), nil
+		}
+		if filepath.Dir(d) == d {
+			return "", nil
+		}
+	}
+}
+
+// Returns the root directory of the module dir belongs to: the closest
+// directory, dir itself or one of its parents, having a go.mod file.
+func findModuleRoot(dir string) (string, error) {
+	for d := dir; ; d = filepath.Dir(d) {
+		if isFile(filepath.Join(d, "go.mod")) {
+			return d, nil
+		}
+		if filepath.Dir(d) == d {
+			return "", fmt.Errorf("no go.mod found in %s or any of its parents", dir)
+		}
+	}
+}
+
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// Returns the module the file or directory at path belongs to, or nil if it
+// is not in any of the analyzed modules.
+func (a *Analyzer) moduleOf(path string) *goModule {
+	for _, m := range a.modules {
+		if path == m.root || strings.HasPrefix(path, m.root+string(filepath.Separator)) {
+			return m
+		}
+	}
+	return nil
+}
+
+// Returns true if the directory is the root of a module that is not
+// analyzed, e.g. one not used by the workspace.
+func (a *Analyzer) isForeignModule(dir string) bool {
+	if !isFile(filepath.Join(dir, "go.mod")) {
+		return false
+	}
+	m := a.moduleOf(dir)
+	return m == nil || m.root != dir
+}
+
+// Returns the import path of the package in the directory, or "" if it is
+// not in any of the analyzed modules.
+func (a *Analyzer) importPath(dir string) string {
+	m := a.moduleOf(dir)
+	if m == nil {
+		return ""
+	}
+	rel, err := filepath.Rel(m.root, dir)
+	if err != nil || rel == "." {
+		return m.path
+	}
+	return m.path + "/" + filepath.ToSlash(rel)
+}
+
+// Returns the path of the file relative to the root of its module, with
+// forward slashes, as shown in logs and used for naming fx modules.
+func (a *Analyzer) relPath(path string) string {
+	m := a.moduleOf(path)
+	if m == nil {
+		return path
+	}
+	rel, err := filepath.Rel(m.root, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,185 @@
+package fxforce5
+
+import (
+	"go/types"
+	"sort"
+)
+
+// NamedDependency is a dependency that got a name invented by fxforce5.
+// When a struct has several fields of the same type, such as
+//
+//	type Store struct {
+//		Primary *sql.DB
+//		Replica *sql.DB
+//	}
+//
+// fx would inject the same value into all of them, so the params fields are
+// tagged `name:"primary"` and `name:"replica"`. The values then have to be
+// provided under these names. If a constructor New<Field> returning the
+// type of the field is found in the module (e.g. NewPrimary), it is
+// annotated with fx.ResultTags(`name:"primary"`); otherwise the provider
+// has to be wired by hand.
+type NamedDependency struct {
+	// Import path of the package of the struct.
+	Package string `json:"package"`
+	Struct  string `json:"struct"`
+	Field   string `json:"field"`
+	// Type of the field.
+	Type string `json:"type"`
+	// Invented name.
+	Name string `json:"name"`
+	// Name of the constructor annotated to provide the named value, or ""
+	// if none was found.
+	Provider string `json:"provider"`
+
+	fieldType types.Type
+}
+
+// NamedDependencies returns the names invented for duplicate-typed fields
+// during Analyze(), Rewrite() or Load(), sorted by package, struct and field.
+func (a *Analyzer) NamedDependencies() []NamedDependency {
+	deps := make([]NamedDependency, 0, len(a.namedDeps))
+	for _, dep := range a.namedDeps {
+		if dep.emitted {
+			deps = append(deps, dep.NamedDependency)
+		}
+	}
+	sortNamedDependencies(deps)
+	return deps
+}
+
+// Sort the named dependencies by package, struct and field.
+func sortNamedDependencies(deps []NamedDependency) {
+	sort.Slice(deps, func(i, j int) bool {
+		if deps[i].Package != deps[j].Package {
+			return deps[i].Package < deps[j].Package
+		}
+		if deps[i].Struct != deps[j].Struct {
+			return deps[i].Struct < deps[j].Struct
+		}
+		return deps[i].Field < deps[j].Field
+	})
+}
+
+type namedDep struct {
+	NamedDependency
+	// Whether a params field was actually tagged with the name.
+	emitted bool
+	// Import path of the package of the provider.
+	providerPkg string
+}
+
+// Key of a named dependency in Analyzer.namedDeps
+func namedDepKey(pkgPath string, structName string, fieldName string) string {
+	return pkgPath + "." + structName + "." + fieldName
+}
+
+// Find the fields of module structs that share their type with another
+// field of the same struct, and invent names for them. Runs once the
+// packages are loaded, before any file is analyzed, so that constructors
+// can be annotated whichever file they are in.
+func (a *Analyzer) findNamedDependencies() {
+	a.namedDeps = make(map[string]*namedDep)
+	if !a.applies(TRANSFORM_NAMED) {
+		return
+	}
+	for _, pkg := range a.packages {
+		if pkg.Types == nil {
+			continue
+		}
+		scope := pkg.Types.Scope()
+		for _, name := range scope.Names() {
+			tn, ok := scope.Lookup(name).(*types.TypeName)
+			if !ok {
+				continue
+			}
+			st, ok := tn.Type().Underlying().(*types.Struct)
+			if !ok {
+				continue
+			}
+			for i := 0; i < st.NumFields(); i++ {
+				field := st.Field(i)
+				if field.Embedded() || field.Name() == "_" {
+					continue
+				}
+				if _, ok := field.Type().(*types.Slice); ok {
+					// Slices are left to value groups
+					continue
+				}
+				for j := 0; j < st.NumFields(); j++ {
+					other := st.Field(j)
+					if i == j || other.Embedded() || !types.Identical(field.Type(), other.Type()) {
+						continue
+					}
+					dep := &namedDep{NamedDependency: NamedDependency{
+						Package:   pkg.PkgPath,
+						Struct:    name,
+						Field:     field.Name(),
+						Type:      types.TypeString(field.Type(), types.RelativeTo(pkg.Types)),
+						Name:      unexportedName(field.Name()),
+						fieldType: field.Type(),
+					}}
+					a.namedDeps[namedDepKey(pkg.PkgPath, name, field.Name())] = dep
+					break
+				}
+			}
+		}
+	}
+}
+
+// Returns the name to tag the params field with, or "".
+func (a *Analyzer) fieldName(af *analyzedFile, structName string, fieldName string) string {
+	if af.pkg == nil {
+		return ""
+	}
+	dep := a.namedDeps[namedDepKey(af.pkg.PkgPath, structName, fieldName)]
+	if dep == nil {
+		return ""
+	}
+	dep.emitted = true
+	return dep.Name
+}
+
+// Annotate the constructors of the file that provide named dependencies:
+// New<Field> returning the type of the field.
+func (a *Analyzer) applyNamedDependencies(af *analyzedFile) {
+	if af.pkg == nil || len(a.namedDeps) == 0 {
+		return
+	}
+	for _, key := range af.ctorKeys() {
+		ctor := af.ctors[key]
+		if ctor.returnInfo.returnKind == multiKind {
+			continue
+		}
+		fn, ok := af.pkg.Types.Scope().Lookup(ctor.providerName()).(*types.Func)
+		if !ok {
+			continue
+		}
+		result := fn.Type().(*types.Signature).Results().At(0).Type()
+		for _, depKey := range a.namedDepKeys() {
+			dep := a.namedDeps[depKey]
+			if ctor.providerName() != "New"+exportedName(dep.Field) || !types.Identical(result, dep.fieldType) {
+				continue
+			}
+			if dep.Provider != "" {
+				a.warnf("%s: %s also provides %s, already provided by %s", af.relPath, ctor.providerName(), dep.Name, dep.Provider)
+				continue
+			}
+			a.debugf("%s: %s provides %s as %s", af.relPath, ctor.providerName(), dep.Type, dep.Name)
+			dep.Provider = ctor.providerName()
+			dep.providerPkg = af.pkgPath
+			ctor.name = dep.Name
+			break
+		}
+	}
+}
+
+// Returns the keys of the named dependencies, sorted.
+func (a *Analyzer) namedDepKeys() []string {
+	keys := make([]string, 0, len(a.namedDeps))
+	for key := range a.namedDeps {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,147 @@
+package fxforce5
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+
+	"github.com/dave/dst"
+)
+
+// Find the fields of module structs that are compared to nil in the
+// methods of the struct or in functions returning it (constructors). Such
+// fields are really optional, so their params fields are tagged
+// `optional:"true"`.
+func (a *Analyzer) findOptionalFields() {
+	a.optionalFields = make(map[string]bool)
+	if !a.applies(TRANSFORM_OPTIONAL) {
+		return
+	}
+	for _, pkg := range a.packages {
+		if pkg.TypesInfo == nil {
+			continue
+		}
+		for _, file := range pkg.Syntax {
+			for _, decl := range file.Decls {
+				fn, ok := decl.(*ast.FuncDecl)
+				if !ok || fn.Body == nil {
+					continue
+				}
+				owner := guardedStruct(pkg.TypesInfo, fn)
+				if owner == nil {
+					continue
+				}
+				ast.Inspect(fn.Body, func(n ast.Node) bool {
+					field := nilCheckedField(pkg.TypesInfo, n, owner)
+					if field != nil && isNilable(field.Type()) {
+						key := namedDepKey(pkg.PkgPath, owner.Obj().Name(), field.Name())
+						if !a.optionalFields[key] {
+							a.debugf("%s: %s.%s is nil-checked, making it optional", pkg.Fset.Position(n.Pos()), owner.Obj().Name(), field.Name())
+						}
+						a.optionalFields[key] = true
+					}
+					return true
+				})
+			}
+		}
+	}
+}
+
+// Returns the struct whose fields guarded by nil checks in the function are
+// optional: the receiver of a method, or the first result of a function.
+func guardedStruct(info *types.Info, fn *ast.FuncDecl) *types.Named {
+	var expr ast.Expr
+	if fn.Recv != nil && len(fn.Recv.List) == 1 {
+		expr = fn.Recv.List[0].Type
+	} else if fn.Type.Results != nil && len(fn.Type.Results.List) > 0 {
+		expr = fn.Type.Results.List[0].Type
+	} else {
+		return nil
+	}
+	t := info.TypeOf(expr)
+	if t == nil {
+		return nil
+	}
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	named, ok := t.(*types.Named)
+	if !ok {
+		return nil
+	}
+	if _, ok := named.Underlying().(*types.Struct); !ok {
+		return nil
+	}
+	return named.Origin()
+}
+
+// If the node is a comparison of a field of the owner struct with nil,
+// returns the field.
+func nilCheckedField(info *types.Info, n ast.Node, owner *types.Named) *types.Var {
+	bin, ok := n.(*ast.BinaryExpr)
+	if !ok || bin.Op != token.EQL && bin.Op != token.NEQ {
+		return nil
+	}
+	operand := bin.X
+	if isNil(info, bin.X) {
+		operand = bin.Y
+	} else if !isNil(info, bin.Y) {
+		return nil
+	}
+	sel, ok := unparen(operand).(*ast.SelectorExpr)
+	if !ok {
+		return nil
+	}
+	selection := info.Selections[sel]
+	if selection == nil || selection.Kind() != types.FieldVal || len(selection.Index()) != 1 {
+		return nil
+	}
+	recv := selection.Recv()
+	if ptr, ok := recv.(*types.Pointer); ok {
+		recv = ptr.Elem()
+	}
+	named, ok := recv.(*types.Named)
+	if !ok || named.Origin() != owner {
+		return nil
+	}
+	return selection.Obj().(*types.Var)
+}
+
+func isNil(info *types.Info, expr ast.Expr) bool {
+	ident, ok := unparen(expr).(*ast.Ident)
+	if !ok {
+		return false
+	}
+	_, ok = info.Uses[ident].(*types.Nil)
+	return ok
+}
+
+// Returns true if values of the type can be nil.
+func isNilable(t types.Type) bool {
+	switch t.Underlying().(type) {
+	case *types.Pointer, *types.Interface, *types.Map, *types.Slice, *types.Signature, *types.Chan:
+		return true
+	}
+	return false
+}
+
+// Returns true if the field of the struct is an optional dependency.
+func (a *Analyzer) isOptionalField(af *analyzedFile, structName string, field *dst.Field, fieldName string) bool {
+	if af.fieldDirectives(field).has(optionalDirective) {
+		return true
+	}
+	if af.pkg == nil {
+		return false
+	}
+	return a.optionalFields[namedDepKey(af.pkg.PkgPath, structName, fieldName)]
+}
+
+func unparen(expr ast.Expr) ast.Expr {
+	for {
+		paren, ok := expr.(*ast.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = paren.X
+	}
+}
@@ -0,0 +1,152 @@
+package fxforce5
+
+import (
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Option configures an Analyzer, see NewAnalyzer().
+type Option func(*Analyzer)
+
+// WithGroupRule adds a rule putting providers into a value group, see
+// GroupRule.
+func WithGroupRule(rule GroupRule) Option {
+	return func(a *Analyzer) {
+		a.groupRules = append(a.groupRules, rule)
+	}
+}
+
+// WithConstructorPattern adds a pattern for constructor names, replacing
+// DEFAULT_CTOR_PATTERN. A function is a constructor candidate if its name
+// matches any of the patterns.
+func WithConstructorPattern(pattern *regexp.Regexp) Option {
+	return func(a *Analyzer) {
+		a.ctorPatterns = append(a.ctorPatterns, pattern)
+	}
+}
+
+// WithFxVersion sets the version of go.uber.org/fx required in go.mod of
+// the rewritten modules, DEFAULT_FX_VERSION by default.
+func WithFxVersion(version string) Option {
+	return func(a *Analyzer) {
+		a.fxVersion = version
+	}
+}
+
+// WithDiutilsVersion has the rewritten code import the diutils package from
+// the fxforce5 module at the version, required in go.mod, rather than from
+// the rewritten module.
+func WithDiutilsVersion(version string) Option {
+	return func(a *Analyzer) {
+		a.diutilsVersion = version
+	}
+}
+
+// WithTestFiles sets what is done with _test.go files, TEST_FILES_SKIP by
+// default.
+func WithTestFiles(policy TestFilePolicy) Option {
+	return func(a *Analyzer) {
+		a.testPolicy = policy
+	}
+}
+
+// WithBuildTags sets the build tags the packages are loaded with, which
+// decide the files analyzed with type information, as for go build -tags.
+func WithBuildTags(tags ...string) Option {
+	return func(a *Analyzer) {
+		a.buildTags = append(a.buildTags, tags...)
+	}
+}
+
+// WithInclude restricts the files rewritten to those matching any of the
+// globs, relative to the analyzed directory, where ** matches any number of
+// directories (internal/**/*.go).
+func WithInclude(globs ...string) Option {
+	return func(a *Analyzer) {
+		a.includes = append(a.includes, globs...)
+	}
+}
+
+// WithExclude excludes the files and directories matching any of the globs,
+// relative to the analyzed directory (internal/**/mocks/*.go), like the
+// ignores given to NewAnalyzer().
+func WithExclude(globs ...string) Option {
+	return func(a *Analyzer) {
+		a.ignores = append(a.ignores, globs...)
+	}
+}
+
+// WithGitignore excludes the files ignored by git, according to the
+// .gitignore files of the analyzed directory, its subdirectories and its
+// parents up to the root of the repository.
+func WithGitignore() Option {
+	return func(a *Analyzer) {
+		a.gitignore = true
+	}
+}
+
+// WithPackages restricts the files rewritten to those of the packages
+// matching any of the patterns, as for the go command: import paths where
+// ... matches any string, or paths relative to the current directory
+// (./internal/...). All packages are still loaded for type information.
+func WithPackages(patterns ...string) Option {
+	return func(a *Analyzer) {
+		a.pkgPatterns = append(a.pkgPatterns, patterns...)
+	}
+}
+
+// WithJobs sets the number of packages analyzed concurrently,
+// runtime.GOMAXPROCS(0) by default. The results do not depend on it.
+func WithJobs(jobs int) Option {
+	return func(a *Analyzer) {
+		a.jobs = jobs
+	}
+}
+
+// WithCacheDir sets the directory the results of the analysis of packages
+// are cached in, fxforce5 under os.UserCacheDir() by default; "" disables
+// the cache. The cache only saves rewriting unchanged packages: all
+// packages are still loaded with type information.
+func WithCacheDir(dir string) Option {
+	return func(a *Analyzer) {
+		a.cacheDir = dir
+	}
+}
+
+// WithDiutilsDir sets the directory, relative to the module root, the
+// diutils package is copied into and imported from when it is local,
+// DEFAULT_DIUTILS_DIR by default.
+func WithDiutilsDir(dir string) Option {
+	return func(a *Analyzer) {
+		a.diutilsDir = strings.Trim(filepath.ToSlash(dir), "/")
+	}
+}
+
+// WithKeepGoing has Analyze() rewrite the files without errors once errors
+// are found, rather than stop before writing anything, see diagnostics.go.
+func WithKeepGoing() Option {
+	return func(a *Analyzer) {
+		a.keepGoing = true
+	}
+}
+
+// WithLogger sets the logger of the run, slog.Default() by default, see
+// logging.go.
+func WithLogger(logger *slog.Logger) Option {
+	return func(a *Analyzer) {
+		a.logger = logger
+	}
+}
+
+// WithTransformations applies only the transformations given, rather than
+// all of them, see Transformation.
+func WithTransformations(transformations ...Transformation) Option {
+	return func(a *Analyzer) {
+		a.transformations = make(map[Transformation]bool)
+		for _, t := range transformations {
+			a.transformations[t] = true
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package fxforce5
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Everything fxforce5 writes (the rewritten files, the diutils package and
+// the go.mod and go.sum files) goes through writeOutput(), either to disk,
+// with Analyze(), or to memory, with Rewrite(), so that fxforce5 can be
+// embedded in other tools, e.g. code generators and tests, without changing
+// the analyzed files. Either way, the analyzed files are read from disk.
+
+// Rewrite rewrites the files under the path as Analyze() does, but without
+// writing anything: it returns what would be written, keyed by absolute
+// path, along with the report. The cache is not used (see WithCacheDir()).
+// As with Analyze(), the report is returned even if the run fails, along
+// with the files written so far.
+func (a *Analyzer) Rewrite() (map[string][]byte, *Report, error) {
+	a.outputs = make(map[string][]byte)
+	a.cacheDir = ""
+	report, err := a.Analyze()
+	return a.outputs, report, err
+}
+
+// Write the file at path, to disk or to memory, see Rewrite(). Safe for
+// concurrent use.
+func (a *Analyzer) writeOutput(path string, buf []byte) error {
+	if a.outputs == nil {
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, buf, 0644)
+	}
+	a.outputsMutex.Lock()
+	defer a.outputsMutex.Unlock()
+	a.outputs[path] = append([]byte{}, buf...)
+	return nil
+}
+
+// Returns an error if the Analyzer already ran: it analyzes the path once,
+// with Analyze(), Rewrite() or Load().
+func (a *Analyzer) start() error {
+	if a.started {
+		return errors.New("the analyzer already ran")
+	}
+	a.started = true
+	return nil
+}
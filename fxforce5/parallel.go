@@ -0,0 +1,204 @@
+package fxforce5
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// Files are analyzed package by package, several packages at a time (see
+// WithJobs()), the files of a package one after the other. The steps
+// needing the files of all packages, such as choosing the providers of
+// named dependencies, run in between, in the order of the walk, so that the
+// results do not depend on the number of jobs:
+//
+//  1. pass 1 of each file, concurrently;
+//  2. rules applying across packages, sequentially;
+//  3. pass 2 of each file, concurrently;
+//  4. writing the rewritten files, concurrently;
+//  5. recording the results and the reports, sequentially.
+//
+// Files with errors drop out after each step, and, unless WithKeepGoing()
+// is given, the run stops before step 4. Packages whose results are cached
+// (see cache.go) skip all of it.
+
+// Analyze the files found by the walk.
+func (a *Analyzer) analyzeFiles() error {
+	groups := a.fileGroups()
+	a.rewrittenCtors = make(map[string]bool)
+	keys := make([]string, len(groups))
+	cached := make([]bool, len(groups))
+	if a.cacheDir != "" {
+		digest := a.cacheDigest()
+		dirHashes := make(map[string]string)
+		for i, group := range groups {
+			dir := filepath.Dir(group[0])
+			key, err := a.cacheKey(dir, group, digest, dirHashes)
+			if err != nil {
+				a.warnf("Not caching %s: %s", dir, err)
+				continue
+			}
+			keys[i] = key
+			if entry := a.loadCacheEntry(dir, key); entry != nil {
+				a.infof("Not rewriting %s -- unchanged since the last run", a.relPath(dir))
+				a.restoreCacheEntry(dir, entry)
+				r := a.packageReport(dir)
+				r.merge(entry.Report)
+				r.Cached = true
+				cached[i] = true
+			}
+		}
+	}
+
+	files, failed := a.inspectFiles(groups, cached)
+	errs := make([][]error, len(groups))
+	for i := range groups {
+		errs[i] = make([]error, len(groups[i]))
+	}
+	// Record the errors of the step, and drop the files having them.
+	recordErrors := func() {
+		for i := range groups {
+			for j, path := range groups[i] {
+				if errs[i][j] != nil {
+					a.fileError(path, errs[i][j])
+					errs[i][j] = nil
+					files[i][j] = nil
+					failed[i] = true
+				}
+			}
+		}
+	}
+
+	rewritten := make([][]bool, len(groups))
+	a.parallel(len(groups), func(i int) {
+		rewritten[i] = make([]bool, len(groups[i]))
+		for j, af := range files[i] {
+			if af != nil {
+				rewritten[i][j], errs[i][j] = af.rewrite()
+			}
+		}
+	})
+	recordErrors()
+	err := a.stopAtErrors()
+	if err != nil {
+		return err
+	}
+
+	a.parallel(len(groups), func(i int) {
+		for j, af := range files[i] {
+			if af != nil && rewritten[i][j] {
+				errs[i][j] = af.write()
+			}
+		}
+	})
+	recordErrors()
+
+	for i := range groups {
+		dir := filepath.Dir(groups[i][0])
+		for j := range groups[i] {
+			if files[i][j] == nil || !rewritten[i][j] {
+				continue
+			}
+			af := files[i][j]
+			af.module.rewritten = true
+			for _, name := range af.renamedCtors {
+				a.rewrittenCtors[af.pkgPath+"."+name] = true
+			}
+		}
+		if cached[i] {
+			continue
+		}
+		report := a.analysisReport(files[i])
+		a.packageReport(dir).merge(report)
+		if keys[i] == "" || failed[i] {
+			continue
+		}
+		entry, err := a.newCacheEntry(dir, files[i], report)
+		if err != nil {
+			a.warnf("Not caching %s: %s", dir, err)
+			continue
+		}
+		a.storeCacheEntry(keys[i], entry)
+	}
+	return nil
+}
+
+// Returns the files found by the walk grouped by directory, in the order of
+// the walk.
+func (a *Analyzer) fileGroups() [][]string {
+	groups := make([][]string, 0)
+	groupOf := make(map[string]int)
+	for _, path := range a.analyzed {
+		dir := filepath.Dir(path)
+		i, ok := groupOf[dir]
+		if !ok {
+			i = len(groups)
+			groupOf[dir] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], path)
+	}
+	return groups
+}
+
+// Inspect the files of the groups but the cached ones (pass 1), and apply
+// the rules across packages to them. Returns the files, nil for those with
+// errors or not to be rewritten, and whether each group had errors.
+func (a *Analyzer) inspectFiles(groups [][]string, cached []bool) ([][]*analyzedFile, []bool) {
+	files := make([][]*analyzedFile, len(groups))
+	errs := make([][]error, len(groups))
+	failed := make([]bool, len(groups))
+	a.parallel(len(groups), func(i int) {
+		files[i] = make([]*analyzedFile, len(groups[i]))
+		errs[i] = make([]error, len(groups[i]))
+		if cached[i] {
+			return
+		}
+		for j, path := range groups[i] {
+			files[i][j], errs[i][j] = a.inspectFile(path)
+		}
+	})
+	for i := range groups {
+		for j, path := range groups[i] {
+			if errs[i][j] != nil {
+				a.fileError(path, errs[i][j])
+				files[i][j] = nil
+				failed[i] = true
+			}
+		}
+	}
+
+	for i := range groups {
+		for _, af := range files[i] {
+			if af != nil {
+				a.applyGroupRules(af)
+				a.applyNamedDependencies(af)
+				a.applyLifecycle(af)
+			}
+		}
+	}
+	return files, failed
+}
+
+// Call f with each index from 0 to n-1, on at most a.jobs goroutines.
+func (a *Analyzer) parallel(n int, f func(i int)) {
+	jobs := a.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
@@ -0,0 +1,310 @@
+package fxforce5
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Report is what Analyze() found and did, package by package, e.g. to
+// track the progress of a migration to fx.
+type Report struct {
+	// Directory analyzed.
+	Dir      string           `json:"dir"`
+	Packages []*PackageReport `json:"packages"`
+	// See NamedDependencies().
+	NamedDependencies []NamedDependency `json:"namedDependencies"`
+}
+
+// PackageReport is what Analyze() found and did in a package. Paths are
+// relative to the analyzed directory.
+type PackageReport struct {
+	// Import path of the package.
+	Path string `json:"path"`
+	Dir  string `json:"dir"`
+	// Whether the results of the analysis come from the cache, see
+	// WithCacheDir().
+	Cached bool `json:"cached,omitempty"`
+	// Files analyzed and rewritten files written.
+	Files   []string `json:"files"`
+	Written []string `json:"written"`
+	// Structs found, and the params structs generated for them.
+	Structs      []string            `json:"structs"`
+	Params       []string            `json:"params"`
+	Constructors []ConstructorReport `json:"constructors"`
+	// Files, directories, structs and constructors left alone.
+	Skipped     []SkipReport `json:"skipped"`
+	Diagnostics []Diagnostic `json:"diagnostics"`
+}
+
+// Kind of constructor, see ConstructorReport.
+type CtorKind string
+
+const (
+	// Function constructing a local struct, rewritten to take a params
+	// struct.
+	CTOR_STRUCT CtorKind = "struct"
+	// Function with several results, rewritten to return an fx.Out struct.
+	CTOR_RESULTS CtorKind = "results"
+	// Function returning a local interface, provided as is.
+	CTOR_INTERFACE CtorKind = "interface"
+	// Function returning any other type, provided as is.
+	CTOR_EXTERNAL CtorKind = "external"
+	// Method of a factory, provided by a generated function.
+	CTOR_METHOD CtorKind = "method"
+	// Package var holding a constructor function, provided as is.
+	CTOR_VAR CtorKind = "var"
+	// Instantiation of a generic constructor, provided as is.
+	CTOR_GENERIC CtorKind = "generic"
+)
+
+// ConstructorReport is a constructor found in a package.
+type ConstructorReport struct {
+	// What is passed to fx.Provide(), e.g. NewCache[string, int].
+	Name string   `json:"name"`
+	File string   `json:"file"`
+	Kind CtorKind `json:"kind"`
+	// Local type constructed, if any.
+	Type string `json:"type,omitempty"`
+	// Whether it was replaced by a generated constructor.
+	Rewritten bool `json:"rewritten"`
+}
+
+// SkipReport is something left alone, and why.
+type SkipReport struct {
+	// File or directory.
+	Path string `json:"path"`
+	// Struct or constructor, "" for the whole file or directory.
+	Name   string `json:"name,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// Returns the kind of the constructor.
+func (ctor *ctorInfo) kind() CtorKind {
+	switch {
+	case ctor.provider == "":
+	case ctor.decl == nil:
+		return CTOR_VAR
+	case ctor.decl.Recv != nil:
+		return CTOR_METHOD
+	default:
+		return CTOR_GENERIC
+	}
+	switch ctor.returnInfo.returnKind {
+	case structKind:
+		return CTOR_STRUCT
+	case multiKind:
+		return CTOR_RESULTS
+	case interfaceKind:
+		return CTOR_INTERFACE
+	}
+	return CTOR_EXTERNAL
+}
+
+// Record that the file, or the struct or constructor of the file with the
+// name, is not rewritten.
+func (af *analyzedFile) skip(name string, reason string) {
+	if name == "" {
+		af.analyzer.debugf("Skipping %s -- %s", af.relPath, reason)
+	} else {
+		af.analyzer.debugf("%s: Skipping %s -- %s", af.relPath, name, reason)
+	}
+	af.skips = append(af.skips, SkipReport{Path: af.analyzer.dirRelPath(af.path), Name: name, Reason: reason})
+}
+
+// Returns the report of the package in the directory, added if needed. Not
+// safe for concurrent use, reports are only added to between the
+// concurrent steps, see analyzeFiles().
+func (a *Analyzer) packageReport(dir string) *PackageReport {
+	if a.reports == nil {
+		a.reports = make(map[string]*PackageReport)
+	}
+	r := a.reports[dir]
+	if r == nil {
+		// Empty rather than nil, for JSON.
+		r = &PackageReport{
+			Path:         a.importPath(dir),
+			Dir:          a.dirRelPath(dir),
+			Files:        []string{},
+			Written:      []string{},
+			Structs:      []string{},
+			Params:       []string{},
+			Constructors: []ConstructorReport{},
+			Skipped:      []SkipReport{},
+			Diagnostics:  []Diagnostic{},
+		}
+		a.reports[dir] = r
+	}
+	return r
+}
+
+// Record that the file or directory found by the walk is not analyzed.
+func (a *Analyzer) skipPath(path string, isDir bool, reason string) {
+	a.debugf("Ignoring (%s): %s", reason, path)
+	dir := path
+	if !isDir {
+		dir = filepath.Dir(path)
+	}
+	r := a.packageReport(dir)
+	r.Skipped = append(r.Skipped, SkipReport{Path: a.dirRelPath(path), Reason: reason})
+}
+
+// Returns the report of the analysis of the files of a package, without
+// what the walk recorded, as cached.
+func (a *Analyzer) analysisReport(files []*analyzedFile) *PackageReport {
+	r := &PackageReport{}
+	for _, af := range files {
+		if af == nil {
+			continue
+		}
+		rel := a.dirRelPath(af.path)
+		r.Skipped = append(r.Skipped, af.skips...)
+		r.Diagnostics = append(r.Diagnostics, af.diagnostics...)
+		if af.ignored {
+			continue
+		}
+		r.Files = append(r.Files, rel)
+		for _, spec := range af.structTypes {
+			r.Structs = append(r.Structs, spec.Name.Name)
+		}
+		for _, key := range af.ctorKeys() {
+			ctor := af.ctors[key]
+			r.Constructors = append(r.Constructors, ConstructorReport{
+				Name:      ctor.providerName(),
+				File:      rel,
+				Kind:      ctor.kind(),
+				Type:      ctor.returnInfo.name,
+				Rewritten: af.written && ctor.renamed,
+			})
+		}
+		if !af.written {
+			continue
+		}
+		r.Written = append(r.Written, a.dirRelPath(newPath(af.path)))
+		params := make([]string, 0, len(af.paramStruct))
+		for _, spec := range af.paramStruct {
+			params = append(params, spec.Name.Name)
+		}
+		sort.Strings(params)
+		r.Params = append(r.Params, params...)
+	}
+	return r
+}
+
+// Add the other report of the same package to the report.
+func (r *PackageReport) merge(other *PackageReport) {
+	r.Files = append(r.Files, other.Files...)
+	r.Written = append(r.Written, other.Written...)
+	r.Structs = append(r.Structs, other.Structs...)
+	r.Params = append(r.Params, other.Params...)
+	r.Constructors = append(r.Constructors, other.Constructors...)
+	r.Skipped = append(r.Skipped, other.Skipped...)
+	r.Diagnostics = append(r.Diagnostics, other.Diagnostics...)
+}
+
+// Returns the number of error diagnostics of the package.
+func (r *PackageReport) errorCount() int {
+	n := 0
+	for _, d := range r.Diagnostics {
+		if d.Severity == SEVERITY_ERROR {
+			n++
+		}
+	}
+	return n
+}
+
+// Returns the report of the run, packages sorted by import path.
+func (a *Analyzer) report() *Report {
+	report := &Report{Dir: a.dir, Packages: make([]*PackageReport, 0, len(a.reports))}
+	for _, r := range a.reports {
+		report.Packages = append(report.Packages, r)
+	}
+	sort.Slice(report.Packages, func(i, j int) bool {
+		if report.Packages[i].Path != report.Packages[j].Path {
+			return report.Packages[i].Path < report.Packages[j].Path
+		}
+		return report.Packages[i].Dir < report.Packages[j].Dir
+	})
+	report.NamedDependencies = a.NamedDependencies()
+	return report
+}
+
+// Errors returns the number of error diagnostics of all packages.
+func (r *Report) Errors() int {
+	n := 0
+	for _, p := range r.Packages {
+		n += p.errorCount()
+	}
+	return n
+}
+
+// WriteText writes the report for humans.
+func (r *Report) WriteText(w io.Writer) error {
+	var b strings.Builder
+	files, written, ctors, rewritten := 0, 0, 0, 0
+	for _, p := range r.Packages {
+		files += len(p.Files)
+		written += len(p.Written)
+		ctors += len(p.Constructors)
+		name := p.Path
+		if name == "" {
+			name = p.Dir
+		}
+		if p.Cached {
+			name += " (cached)"
+		}
+		fmt.Fprintf(&b, "%s\n", name)
+		if len(p.Structs) > 0 {
+			fmt.Fprintf(&b, "  structs: %s\n", strings.Join(p.Structs, ", "))
+		}
+		if len(p.Constructors) > 0 {
+			fmt.Fprintf(&b, "  constructors:\n")
+			for _, ctor := range p.Constructors {
+				state := "provided as is"
+				if ctor.Rewritten {
+					state = "rewritten"
+					rewritten++
+				}
+				fmt.Fprintf(&b, "    %s (%s, %s) %s\n", ctor.Name, ctor.Kind, state, ctor.File)
+			}
+		}
+		if len(p.Params) > 0 {
+			fmt.Fprintf(&b, "  params: %s\n", strings.Join(p.Params, ", "))
+		}
+		if len(p.Written) > 0 {
+			fmt.Fprintf(&b, "  written: %s\n", strings.Join(p.Written, ", "))
+		}
+		if len(p.Skipped) > 0 {
+			fmt.Fprintf(&b, "  skipped:\n")
+			for _, s := range p.Skipped {
+				what := s.Path
+				if s.Name != "" {
+					what += ": " + s.Name
+				}
+				fmt.Fprintf(&b, "    %s -- %s\n", what, s.Reason)
+			}
+		}
+		if len(p.Diagnostics) > 0 {
+			fmt.Fprintf(&b, "  diagnostics:\n")
+			for _, d := range p.Diagnostics {
+				fmt.Fprintf(&b, "    %s\n", d.String())
+			}
+		}
+	}
+	if len(r.NamedDependencies) > 0 {
+		fmt.Fprintf(&b, "named dependencies:\n")
+		for _, dep := range r.NamedDependencies {
+			provider := dep.Provider
+			if provider == "" {
+				provider = "no provider found, wire with fx.Annotate(..., fx.ResultTags(`name:\"" + dep.Name + "\"`))"
+			}
+			fmt.Fprintf(&b, "  %s.%s.%s (%s) as %q: %s\n", dep.Package, dep.Struct, dep.Field, dep.Type, dep.Name, provider)
+		}
+	}
+	fmt.Fprintf(&b, "%d packages, %d files analyzed, %d written, %d of %d constructors rewritten, %d errors\n",
+		len(r.Packages), files, written, rewritten, ctors, r.Errors())
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,210 @@
+package fxforce5
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strconv"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
+)
+
+// Constructors with several (non-error) results, such as
+//
+//	func NewClient(cfg Config) (*Client, *HealthChecker, error)
+//
+// provide all of them through an fx.Out struct named after the constructor:
+//
+//	type NewClientResult struct {
+//		fx.Out
+//		Client        *Client
+//		HealthChecker *HealthChecker
+//	}
+//
+//	func NewClient(cfg Config) (NewClientResult, error) {
+//		return diutils.OutErr[NewClientResult](NewClientOrig(cfg))
+//	}
+//
+// Unlike single-result constructors, the arguments are kept as they are:
+// fx injects them directly, and there is no single struct whose fields
+// could make up a params struct. Constructors returning the same type more
+// than once are not rewritten, as fx cannot provide it twice.
+
+// Get information about the "return object" of a constructor with several
+// results. It is keyed by the name of the first result type, so that it
+// competes with other constructors of that type, see chooseCtors().
+func (af *analyzedFile) getMultiReturnInfo(ctorName string, results []dst.Expr) *returnInfo {
+	name := resultFieldName(results[0])
+	if name == "" {
+		name = ctorName
+	}
+	return &returnInfo{
+		name:       name,
+		returnKind: multiKind,
+	}
+}
+
+// Returns the first result of the same type as an earlier one, or nil.
+func (af *analyzedFile) duplicateResult(results []dst.Expr) dst.Expr {
+	for i, result := range results {
+		for _, earlier := range results[:i] {
+			if af.sameType(result, earlier) {
+				return result
+			}
+		}
+	}
+	return nil
+}
+
+// Returns true if the type expressions of the file denote the same type,
+// or, without type information, are written the same.
+func (af *analyzedFile) sameType(x dst.Expr, y dst.Expr) bool {
+	astX, okX := af.decorator.Map.Ast.Nodes[x].(ast.Expr)
+	astY, okY := af.decorator.Map.Ast.Nodes[y].(ast.Expr)
+	if !okX || !okY {
+		return false
+	}
+	if af.pkg != nil && af.pkg.TypesInfo != nil {
+		typeX, typeY := af.pkg.TypesInfo.TypeOf(astX), af.pkg.TypesInfo.TypeOf(astY)
+		if typeX != nil && typeY != nil {
+			return types.Identical(typeX, typeY)
+		}
+	}
+	return types.ExprString(astX) == types.ExprString(astY)
+}
+
+// Name of the field of the result struct holding a value of type expr.
+func resultFieldName(expr dst.Expr) string {
+	switch e := expr.(type) {
+	case *dst.StarExpr:
+		return resultFieldName(e.X)
+	case *dst.SelectorExpr:
+		return e.Sel.Name
+	case *dst.Ident:
+		return exportedName(e.Name)
+	}
+	return ""
+}
+
+// Prepare the fx.Out struct declaration for a constructor with several
+// results.
+func (af *analyzedFile) getResultStruct(name string, ctor *ctorInfo) (*dst.GenDecl, error) {
+	fields := []*dst.Field{{Type: &dst.Ident{Name: af.fxName + ".Out"}}}
+	used := make(map[string]int)
+	for i, result := range ctor.results {
+		fieldName := resultFieldName(result)
+		if fieldName == "" {
+			fieldName = "Result" + strconv.Itoa(i)
+		}
+		used[fieldName]++
+		if used[fieldName] > 1 {
+			fieldName += strconv.Itoa(used[fieldName])
+		}
+		if !dst.IsExported(fieldName) {
+			return nil, af.errorAt(result, DIAG_EXPORT, "cannot name result %d of %s: %s is not exported", i, ctor.providerName(), fieldName)
+		}
+		fields = append(fields, &dst.Field{
+			Names: []*dst.Ident{{Name: fieldName}},
+			Type:  dst.Clone(result).(dst.Expr),
+		})
+	}
+	return &dst.GenDecl{
+		Tok: token.TYPE,
+		Specs: []dst.Spec{&dst.TypeSpec{
+			Name: &dst.Ident{Name: name},
+			Type: &dst.StructType{Fields: &dst.FieldList{List: fields}},
+		}},
+	}, nil
+}
+
+// Returns a copy of the parameters of a function, with every parameter
+// named so that they can be passed on, and the expressions to pass them.
+func forwardedParams(params *dst.FieldList) (*dst.FieldList, []dst.Expr, bool) {
+	fields := &dst.FieldList{}
+	args := make([]dst.Expr, 0)
+	variadic := false
+	taken := make(map[string]bool)
+	for _, param := range params.List {
+		for _, name := range param.Names {
+			taken[name.Name] = true
+		}
+	}
+	i := 0
+	for _, param := range params.List {
+		field := &dst.Field{Type: dst.Clone(param.Type).(dst.Expr)}
+		names := param.Names
+		if len(names) == 0 {
+			names = []*dst.Ident{{Name: "_"}}
+		}
+		for _, name := range names {
+			argName := name.Name
+			for n := i; argName == "_" || argName != name.Name && taken[argName]; n++ {
+				argName = "p" + strconv.Itoa(n)
+			}
+			taken[argName] = true
+			field.Names = append(field.Names, &dst.Ident{Name: argName})
+			args = append(args, &dst.Ident{Name: argName})
+			i++
+		}
+		if _, ok := param.Type.(*dst.Ellipsis); ok {
+			variadic = true
+		}
+		fields.List = append(fields.List, field)
+	}
+	return fields, args, variadic
+}
+
+// Add the result struct and the new constructor returning it before the
+// (already renamed) original constructor at the cursor.
+func (af *analyzedFile) rewriteMultiCtor(c *dstutil.Cursor, ctorName string, ctor *ctorInfo) {
+	resultStructName := ctorName + "Result"
+	resultDecl, err := af.getResultStruct(resultStructName, ctor)
+	if err != nil {
+		af.err = err
+		return
+	}
+	af.analyzer.debugf("Inserting %s before %s", resultStructName, ctorName)
+	c.InsertBefore(resultDecl)
+
+	params, args, variadic := forwardedParams(ctor.decl.Type.Params)
+
+	// return diutils.Out[NewClientResult](NewClientOrig(cfg))
+	diutilsFuncName := "Out"
+	if ctor.returnsErr {
+		diutilsFuncName += "Err"
+	}
+	origCall := &dst.CallExpr{
+		Fun:      &dst.Ident{Name: ctor.decl.Name.Name},
+		Args:     args,
+		Ellipsis: variadic,
+	}
+	outCall := &dst.CallExpr{
+		Fun: &dst.IndexExpr{
+			X: &dst.SelectorExpr{
+				X:   &dst.Ident{Name: af.diutilsName},
+				Sel: &dst.Ident{Name: diutilsFuncName},
+			},
+			Index: &dst.Ident{Name: resultStructName},
+		},
+		Args: []dst.Expr{origCall},
+	}
+
+	results := &dst.FieldList{List: []*dst.Field{{Type: &dst.Ident{Name: resultStructName}}}}
+	if ctor.returnsErr {
+		results.List = append(results.List, &dst.Field{Type: &dst.Ident{Name: "error"}})
+	}
+
+	newCtor := &dst.FuncDecl{
+		Name: &dst.Ident{Name: ctorName},
+		Type: &dst.FuncType{
+			Func:    true,
+			Params:  params,
+			Results: results,
+		},
+		Body: &dst.BlockStmt{
+			List: []dst.Stmt{&dst.ReturnStmt{Results: []dst.Expr{outCall}}},
+		},
+	}
+	c.InsertBefore(newCtor)
+}
@@ -0,0 +1,220 @@
+package fxforce5
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// Files are selected for rewriting with:
+//
+//   - include and exclude globs, matched against paths relative to the
+//     analyzed directory with forward slashes, where ** matches any number
+//     of directories (internal/**/mocks/*.go); exclude globs matching a
+//     directory exclude all of it;
+//   - optionally, the .gitignore files of the analyzed directory, its
+//     subdirectories and its parents up to the root of the repository;
+//   - package patterns, as for the go command: import paths where ...
+//     matches any string (example.com/x/internal/...), or relative paths
+//     (./internal/...).
+//
+// Packages not selected are still loaded, so that type information of the
+// whole module is available.
+
+// A rule of a .gitignore file.
+type gitignoreRule struct {
+	// Directory of the .gitignore file.
+	dir     string
+	pattern string
+	// The pattern is negated with !, re-including what it matches.
+	negate bool
+	// The pattern ends with /, matching directories only.
+	dirOnly bool
+}
+
+// Validate the patterns given as options, and resolve the relative package
+// patterns. Called by Analyze() once the directory is known.
+func (a *Analyzer) prepareSelection() error {
+	for _, pattern := range append(append([]string{}, a.includes...), a.ignores...) {
+		if !doublestar.ValidatePattern(pattern) {
+			return fmt.Errorf("invalid glob %q", pattern)
+		}
+	}
+	a.pkgRegexps = make([]*regexp.Regexp, 0, len(a.pkgPatterns))
+	for _, pattern := range a.pkgPatterns {
+		if pattern == "." || pattern == ".." || strings.HasPrefix(pattern, "./") || strings.HasPrefix(pattern, "../") {
+			dir, err := filepath.Abs(strings.TrimSuffix(strings.TrimSuffix(pattern, "..."), "/"))
+			if err != nil {
+				return err
+			}
+			importPath := a.importPath(dir)
+			if importPath == "" {
+				return fmt.Errorf("package pattern %s is not in any of the analyzed modules", pattern)
+			}
+			if strings.HasSuffix(pattern, "...") {
+				importPath += "/..."
+			}
+			pattern = importPath
+		}
+		a.pkgRegexps = append(a.pkgRegexps, packagePatternRegexp(pattern))
+	}
+	if a.gitignore {
+		// .gitignore files of the directory and its parents, outermost
+		// first; those of the subdirectories are loaded by the walker.
+		dirs := make([]string, 0)
+		for d := a.dir; ; d = filepath.Dir(d) {
+			dirs = append([]string{d}, dirs...)
+			if _, err := os.Stat(filepath.Join(d, ".git")); err == nil || d == filepath.Dir(d) {
+				break
+			}
+		}
+		for _, d := range dirs {
+			err := a.loadGitignore(d)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the regular expression matching the import paths matched by the
+// package pattern. As for the go command, x/... matches x as well.
+func packagePatternRegexp(pattern string) *regexp.Regexp {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.ReplaceAll(re, `/\.\.\.`, `(/.*)?`)
+	re = strings.ReplaceAll(re, `\.\.\.`, `.*`)
+	return regexp.MustCompile("^" + re + "$")
+}
+
+// Load the rules of the .gitignore file of the directory, if any.
+func (a *Analyzer) loadGitignore(dir string) error {
+	f, err := os.Open(filepath.Join(dir, ".gitignore"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " ")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := gitignoreRule{dir: dir}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		line = strings.TrimPrefix(line, `\`)
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		// Patterns without a slash match at any depth, others are
+		// relative to the directory of the .gitignore file.
+		if strings.Contains(line, "/") {
+			rule.pattern = strings.TrimPrefix(line, "/")
+		} else {
+			rule.pattern = "**/" + line
+		}
+		if !doublestar.ValidatePattern(rule.pattern) {
+			a.warnf("%s: Ignoring invalid pattern %s", filepath.Join(dir, ".gitignore"), line)
+			continue
+		}
+		a.gitignoreRules = append(a.gitignoreRules, rule)
+	}
+	return scanner.Err()
+}
+
+// Returns true if the file or directory is ignored by the .gitignore rules:
+// the last rule matching it does not negate.
+func (a *Analyzer) isGitignored(path string, isDir bool) bool {
+	ignored := false
+	for _, rule := range a.gitignoreRules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		rel, err := filepath.Rel(rule.dir, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if ok, _ := doublestar.Match(rule.pattern, filepath.ToSlash(rel)); ok {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// Returns the reason why the directory is not walked, or "" if it is.
+func (a *Analyzer) dirSelectReason(path string) (string, error) {
+	if a.gitignore {
+		if a.isGitignored(path, true) {
+			return "gitignored", nil
+		}
+		err := a.loadGitignore(path)
+		if err != nil {
+			return "", err
+		}
+	}
+	rel := a.dirRelPath(path)
+	for _, pattern := range a.ignores {
+		if ok, _ := doublestar.Match(pattern, rel); ok {
+			return "excluded by " + pattern, nil
+		}
+	}
+	return "", nil
+}
+
+// Returns the reason why the Go file is not selected for rewriting, or "" if
+// it is.
+func (a *Analyzer) fileSelectReason(path string) string {
+	rel := a.dirRelPath(path)
+	for _, pattern := range a.ignores {
+		if ok, _ := doublestar.Match(pattern, rel); ok {
+			return "excluded by " + pattern
+		}
+	}
+	if len(a.includes) > 0 {
+		included := false
+		for _, pattern := range a.includes {
+			if ok, _ := doublestar.Match(pattern, rel); ok {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return "not included"
+		}
+	}
+	if a.gitignore && a.isGitignored(path, false) {
+		return "gitignored"
+	}
+	if len(a.pkgRegexps) > 0 {
+		importPath := a.importPath(filepath.Dir(path))
+		for _, pattern := range a.pkgRegexps {
+			if pattern.MatchString(importPath) {
+				return ""
+			}
+		}
+		return "package " + importPath + " not selected"
+	}
+	return ""
+}
+
+// Returns the path relative to the analyzed directory, with forward
+// slashes, as include and exclude globs are matched against.
+func (a *Analyzer) dirRelPath(path string) string {
+	rel, err := filepath.Rel(a.dir, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,40 @@
+package fxforce5
+
+import "fmt"
+
+// Transformation is a part of the rewrite that can be left out, see
+// WithTransformations(). Constructors are always rewritten to take params
+// structs, and provided in the fx.Module of their file.
+type Transformation string
+
+const (
+	// Providers are put into value groups, see GroupRule.
+	TRANSFORM_GROUPS Transformation = "groups"
+	// Fields of the same type are named, see NamedDependency.
+	TRANSFORM_NAMED Transformation = "named"
+	// Fields checked for nil are optional, see findOptionalFields(). Fields
+	// marked with the optional directive still are.
+	TRANSFORM_OPTIONAL Transformation = "optional"
+	// Lifecycle methods are registered as fx hooks, see applyLifecycle().
+	TRANSFORM_LIFECYCLE Transformation = "lifecycle"
+	// Requirements are added to go.mod and go.sum, see updateGoMods().
+	TRANSFORM_GO_MOD Transformation = "go-mod"
+)
+
+// All transformations, applied by default.
+var TRANSFORMATIONS = []Transformation{TRANSFORM_GROUPS, TRANSFORM_NAMED, TRANSFORM_OPTIONAL, TRANSFORM_LIFECYCLE, TRANSFORM_GO_MOD}
+
+// ParseTransformation parses the name of a transformation, e.g. "groups".
+func ParseTransformation(s string) (Transformation, error) {
+	for _, t := range TRANSFORMATIONS {
+		if string(t) == s {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("unknown transformation %q, expected one of %v", s, TRANSFORMATIONS)
+}
+
+// Returns true if the transformation is applied.
+func (a *Analyzer) applies(t Transformation) bool {
+	return a.transformations == nil || a.transformations[t]
+}
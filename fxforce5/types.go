@@ -0,0 +1,189 @@
+package fxforce5
+
+import (
+	"go/types"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// Load type information for all packages of the modules. Errors in the
+// analyzed code are not fatal: files of packages that could not be loaded
+// are still rewritten, but without the rewrites that need type information.
+// Failures of the go command are errors, see loadError().
+// Each module is loaded from its root, so that the go command resolves its
+// dependencies (including other modules of the workspace) as it would
+// building it. The files rewritten by a previous run are loaded empty, see
+// rewrittenOverlay().
+func (a *Analyzer) loadPackages() error {
+	overlay, err := a.rewrittenOverlay()
+	if err != nil {
+		return err
+	}
+	modules := make([]*goModule, len(a.modules))
+	copy(modules, a.modules)
+	sort.Slice(modules, func(i, j int) bool {
+		return modules[i].root < modules[j].root
+	})
+	a.pkgByFile = make(map[string]*packages.Package)
+	for _, m := range modules {
+		conf := *a.conf
+		conf.Dir = m.root
+		conf.Fset = a.fileSet
+		conf.Overlay = overlay
+		pkgs, err := packages.Load(&conf, "./...")
+		if err != nil {
+			// The files of the module are analyzed without type
+			// information, if the run keeps going.
+			a.loadError(m.root, err)
+			continue
+		}
+		packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+			if pkg.Module == nil || pkg.Module.Path != m.path {
+				return
+			}
+			a.packageErrors(pkg)
+			a.packages = append(a.packages, pkg)
+			for _, file := range pkg.CompiledGoFiles {
+				a.pkgByFile[filepath.Clean(file)] = pkg
+			}
+		})
+	}
+	return nil
+}
+
+// Returns the package the file at path belongs to, or nil if its type
+// information is not available. Files not in the current build, see
+// skipReason(), get the package of the files in the build of the same
+// directory and package name, without type information of their own.
+func (a *Analyzer) packageOf(path string, pkgName string) *packages.Package {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+	pkg := a.pkgByFile[abs]
+	if pkg == nil {
+		for _, other := range a.packages {
+			if other.Name == pkgName && len(other.CompiledGoFiles) > 0 && filepath.Dir(other.CompiledGoFiles[0]) == filepath.Dir(abs) {
+				pkg = other
+			}
+		}
+	}
+	if pkg == nil || pkg.Types == nil || pkg.IllTyped {
+		return nil
+	}
+	return pkg
+}
+
+// Finds a named type by its name, qualified by import path
+// ("example.com/x/http.Route") or not ("Route"). Unqualified names are
+// looked up in the package of the file first. Qualified names are looked up
+// in the imports of the package of the file first, as packages of other
+// modules are loaded separately and their types are not identical to the
+// ones the file uses.
+func (a *Analyzer) lookupNamed(name string, pkg *packages.Package) *types.Named {
+	pkgPath := ""
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		pkgPath, name = name[:i], name[i+1:]
+	}
+	candidates := make([]*packages.Package, 0, len(a.packages)+1)
+	if pkgPath == "" && pkg != nil {
+		candidates = append(candidates, pkg)
+	}
+	if pkgPath != "" && pkg != nil {
+		packages.Visit([]*packages.Package{pkg}, nil, func(p *packages.Package) {
+			candidates = append(candidates, p)
+		})
+	}
+	candidates = append(candidates, a.packages...)
+	for _, p := range candidates {
+		if p.Types == nil || pkgPath != "" && p.PkgPath != pkgPath {
+			continue
+		}
+		if tn, ok := p.Types.Scope().Lookup(name).(*types.TypeName); ok {
+			if named, ok := tn.Type().(*types.Named); ok {
+				return named
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the named type declared in the file's package with the given
+// name, or nil if there is no type information.
+func (af *analyzedFile) localNamed(name string) *types.Named {
+	if af.pkg == nil {
+		return nil
+	}
+	tn, ok := af.pkg.Types.Scope().Lookup(name).(*types.TypeName)
+	if !ok {
+		return nil
+	}
+	named, _ := tn.Type().(*types.Named)
+	return named
+}
+
+// Returns the type of the named field of the local struct type, or nil.
+func (af *analyzedFile) localFieldType(structName string, fieldName string) types.Type {
+	named := af.localNamed(structName)
+	if named == nil {
+		return nil
+	}
+	st, ok := named.Underlying().(*types.Struct)
+	if !ok {
+		return nil
+	}
+	for i := 0; i < st.NumFields(); i++ {
+		if st.Field(i).Name() == fieldName {
+			return st.Field(i).Type()
+		}
+	}
+	return nil
+}
+
+// Returns true if the params struct of the local struct type has a field
+// with the given name: unexported fields of the struct are exported in its
+// params struct, see pass2Apply(). Embedded fields are copied as is.
+func (af *analyzedFile) paramsHasField(structName string, fieldName string) bool {
+	named := af.localNamed(structName)
+	if named == nil {
+		return false
+	}
+	st, ok := named.Underlying().(*types.Struct)
+	if !ok {
+		return false
+	}
+	for i := 0; i < st.NumFields(); i++ {
+		name := st.Field(i).Name()
+		if name != "_" && !st.Field(i).Embedded() && !st.Field(i).Exported() {
+			name = exportedName(name)
+		}
+		if name == fieldName {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the expression referring to the type from the file, adding an
+// import of its package if needed.
+func (af *analyzedFile) typeExpr(named *types.Named) string {
+	obj := named.Obj()
+	if obj.Pkg() == nil || af.pkg != nil && obj.Pkg().Path() == af.pkg.PkgPath {
+		return obj.Name()
+	}
+	return af.importName(obj.Pkg().Path(), obj.Pkg().Name()) + "." + obj.Name()
+}
+
+// Returns the expression referring to any type from the file, adding
+// imports of the packages it needs.
+func (af *analyzedFile) typeString(t types.Type) string {
+	return types.TypeString(t, func(pkg *types.Package) string {
+		if af.pkg != nil && pkg.Path() == af.pkg.PkgPath {
+			return ""
+		}
+		return af.importName(pkg.Path(), pkg.Name())
+	})
+}
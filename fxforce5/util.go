@@ -1,5 +1,15 @@
 package fxforce5
 
+import (
+	"go/token"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dave/dst"
+)
+
 // In returns true if needle is found in haystack.
 func In(needle string, haystack []string) bool {
 	for _, s := range haystack {
@@ -9,3 +19,93 @@ func In(needle string, haystack []string) bool {
 	}
 	return false
 }
+
+// isErrorType returns true if expr is the predeclared error type.
+func isErrorType(expr dst.Expr) bool {
+	ident, ok := expr.(*dst.Ident)
+	return ok && ident.Name == "error" && ident.Path == ""
+}
+
+// flattenFields returns the type of every name in the field list, so that
+// (a, b int) yields two entries. Unnamed fields yield one entry each.
+func flattenFields(fields *dst.FieldList) []dst.Expr {
+	if fields == nil {
+		return nil
+	}
+	types := make([]dst.Expr, 0, len(fields.List))
+	for _, field := range fields.List {
+		n := len(field.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			types = append(types, field.Type)
+		}
+	}
+	return types
+}
+
+// exportedName returns name with its first letter upper-cased.
+func exportedName(name string) string {
+	r, size := utf8.DecodeRuneInString(name)
+	if r == '_' && size < len(name) {
+		return exportedName(name[size:])
+	}
+	return string(unicode.ToUpper(r)) + name[size:]
+}
+
+// unexportedName returns name with its leading upper-case letters
+// lower-cased, keeping the last one of an initialism that starts the next
+// word: Primary -> primary, DB -> db, DBPrimary -> dbPrimary.
+func unexportedName(name string) string {
+	runes := []rune(name)
+	for i := range runes {
+		if !unicode.IsUpper(runes[i]) {
+			break
+		}
+		if i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1]) {
+			break
+		}
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	return string(runes)
+}
+
+// structTag builds a struct field tag from key/value pairs, preserving the
+// order in which they were added.
+type structTag struct {
+	keys   []string
+	values map[string]string
+}
+
+// add sets key to value, replacing any previous value of key.
+func (t *structTag) add(key string, value string) {
+	if t.values == nil {
+		t.values = make(map[string]string)
+	}
+	if _, ok := t.values[key]; !ok {
+		t.keys = append(t.keys, key)
+	}
+	t.values[key] = value
+}
+
+func (t *structTag) empty() bool {
+	return len(t.keys) == 0
+}
+
+func (t *structTag) String() string {
+	parts := make([]string, 0, len(t.keys))
+	for _, key := range t.keys {
+		parts = append(parts, key+":"+strconv.Quote(t.values[key]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// lit returns the tag as a raw string literal suitable for dst.Field.Tag,
+// or nil if the tag is empty.
+func (t *structTag) lit() *dst.BasicLit {
+	if t.empty() {
+		return nil
+	}
+	return &dst.BasicLit{Kind: token.STRING, Value: "`" + t.String() + "`"}
+}
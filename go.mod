@@ -3,19 +3,17 @@ module github.com/debedb/fxforce5
 go 1.21.0
 
 require (
+	github.com/bmatcuk/doublestar/v4 v4.10.0
+	github.com/dave/dst v0.27.3
+	go.uber.org/fx v1.20.1
 	golang.org/x/mod v0.13.0
 	golang.org/x/text v0.14.0
 	golang.org/x/tools v0.14.0
 )
 
 require (
-	github.com/dave/dst v0.27.3 // indirect
-	github.com/mattn/go-colorable v0.1.13 // indirect
-	github.com/mattn/go-isatty v0.0.19 // indirect
-	github.com/rs/zerolog v1.31.0 // indirect
 	go.uber.org/atomic v1.7.0 // indirect
 	go.uber.org/dig v1.17.0 // indirect
-	go.uber.org/fx v1.20.1 // indirect
 	go.uber.org/multierr v1.6.0 // indirect
 	go.uber.org/zap v1.23.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
@@ -0,0 +1,464 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/debedb/fxforce5/diutils"
+	"github.com/debedb/fxforce5/fxforce5"
+)
+
+// Returns a logger writing to w what is logged at the level or above.
+func newTestLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// Write a module of packages with files each declaring a struct and its
+// constructor, depending on the struct of the previous package.
+func writeSyntheticModule(b testing.TB, dir string, packages int, files int) {
+	writeSyntheticGoMod(b, dir)
+	for p := 0; p < packages; p++ {
+		pkgDir := filepath.Join(dir, fmt.Sprintf("pkg%d", p))
+		err := os.Mkdir(pkgDir, 0755)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for f := 0; f < files; f++ {
+			var src strings.Builder
+			fmt.Fprintf(&src, "package pkg%d\n\n", p)
+			dep := ""
+			if p > 0 {
+				fmt.Fprintf(&src, "import \"example.com/synthetic/pkg%d\"\n\n", p-1)
+				dep = fmt.Sprintf("\tDep *pkg%d.Service%d\n", p-1, f)
+			}
+			fmt.Fprintf(&src, "type Service%d struct {\n\tName string\n%s}\n\n", f, dep)
+			fmt.Fprintf(&src, "func NewService%d(name string) *Service%d {\n\treturn &Service%d{Name: name}\n}\n", f, f, f)
+			err := os.WriteFile(filepath.Join(pkgDir, fmt.Sprintf("service%d.go", f)), []byte(src.String()), 0644)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func writeSyntheticGoMod(b testing.TB, dir string) {
+	err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/synthetic\n\ngo 1.21\n"), 0644)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = os.RemoveAll(filepath.Join(dir, "go.sum"))
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+// Remove what Analyze() writes, so that every run does the same work.
+func cleanSyntheticModule(b *testing.B, dir string) {
+	writeSyntheticGoMod(b, dir)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == "diutils" {
+			err := os.RemoveAll(path)
+			if err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		if strings.HasSuffix(path, "_new.go") {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkAnalyze(b *testing.B) {
+	logger := newTestLogger(io.Discard, slog.LevelWarn)
+	dir := b.TempDir()
+	writeSyntheticModule(b, dir, 40, 25)
+	for _, jobs := range []int{1, 4} {
+		b.Run(fmt.Sprintf("j%d", jobs), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				cleanSyntheticModule(b, dir)
+				b.StartTimer()
+				_, err := fxforce5.NewAnalyzer(dir, nil, fxforce5.WithJobs(jobs), fxforce5.WithCacheDir(""), fxforce5.WithLogger(logger)).Analyze()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAnalyzeIsDeterministic(t *testing.T) {
+	logger := newTestLogger(io.Discard, slog.LevelWarn)
+	dir := t.TempDir()
+	writeSyntheticModule(t, dir, 6, 8)
+	outputs := make([]map[string][]byte, 0)
+	for _, jobs := range []int{1, 4} {
+		files, _, err := fxforce5.NewAnalyzer(dir, nil, fxforce5.WithJobs(jobs), fxforce5.WithLogger(logger)).Rewrite()
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, files)
+	}
+	if len(outputs[0]) == 0 || len(outputs[0]) != len(outputs[1]) {
+		t.Errorf("expected the same files to be written with -j1 and -j4, got %d and %d", len(outputs[0]), len(outputs[1]))
+	}
+	for path, buf := range outputs[0] {
+		if !bytes.Equal(buf, outputs[1][path]) {
+			t.Errorf("%s differs between -j1 and -j4, got\n%s\nand\n%s", path, buf, outputs[1][path])
+		}
+	}
+}
+
+// Write a module with a package with a constructor, a generated file and a
+// file with a syntax error.
+func writeReportModule(t *testing.T) string {
+	dir := t.TempDir()
+	writeSyntheticGoMod(t, dir)
+	pkgDir := filepath.Join(dir, "svc")
+	err := os.Mkdir(pkgDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"server.go": "package svc\n\ntype Server struct {\n\tName string\n}\n\nfunc NewServer(name string) *Server {\n\treturn &Server{Name: name}\n}\n",
+		"gen.go":    "// Code generated by hand. DO NOT EDIT.\n\npackage svc\n",
+		"bad.go":    "package svc\n\nfunc NewBad( {\n",
+	}
+	for name, src := range files {
+		err := os.WriteFile(filepath.Join(pkgDir, name), []byte(src), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestAnalyzeReport(t *testing.T) {
+	dir := writeReportModule(t)
+	var logs bytes.Buffer
+	logger := newTestLogger(&logs, slog.LevelWarn)
+	report, err := fxforce5.NewAnalyzer(dir, nil, fxforce5.WithCacheDir(""), fxforce5.WithKeepGoing(), fxforce5.WithLogger(logger)).Analyze()
+	if err == nil {
+		t.Fatal("expected an error for svc/bad.go")
+	}
+	if !strings.Contains(logs.String(), "level=ERROR msg=\"svc/bad.go:3:") || strings.Contains(logs.String(), "level=INFO") {
+		t.Errorf("expected only warnings and errors to be logged, including svc/bad.go:3, got\n%s", logs.String())
+	}
+	if len(report.Packages) != 1 {
+		t.Fatalf("expected 1 package, got %+v", report.Packages)
+	}
+	pkg := report.Packages[0]
+	if pkg.Path != "example.com/synthetic/svc" {
+		t.Errorf("expected example.com/synthetic/svc, got %s", pkg.Path)
+	}
+	expected := []fxforce5.ConstructorReport{{Name: "NewServer", File: "svc/server.go", Kind: fxforce5.CTOR_STRUCT, Type: "Server", Rewritten: true}}
+	if fmt.Sprint(pkg.Constructors) != fmt.Sprint(expected) {
+		t.Errorf("expected constructors %+v, got %+v", expected, pkg.Constructors)
+	}
+	if fmt.Sprint(pkg.Params) != "[ServerParams]" || fmt.Sprint(pkg.Written) != "[svc/server_new.go]" {
+		t.Errorf("expected ServerParams in svc/server_new.go, got %v in %v", pkg.Params, pkg.Written)
+	}
+	if len(pkg.Skipped) != 1 || pkg.Skipped[0].Path != "svc/gen.go" || pkg.Skipped[0].Reason != "generated" {
+		t.Errorf("expected svc/gen.go to be skipped as generated, got %+v", pkg.Skipped)
+	}
+	if report.Errors() != 1 {
+		t.Fatalf("expected 1 error, got %+v", pkg.Diagnostics)
+	}
+	for _, d := range pkg.Diagnostics {
+		if d.Severity == fxforce5.SEVERITY_ERROR && (d.Code != fxforce5.DIAG_SYNTAX || d.Pos.Filename != "svc/bad.go" || d.Pos.Line != 3) {
+			t.Errorf("expected a syntax error at svc/bad.go:3, got %s", d.String())
+		}
+	}
+}
+
+func TestAnalyzeStopsAtErrors(t *testing.T) {
+	dir := writeReportModule(t)
+	logger := newTestLogger(io.Discard, slog.LevelWarn)
+	report, err := fxforce5.NewAnalyzer(dir, nil, fxforce5.WithCacheDir(""), fxforce5.WithLogger(logger)).Analyze()
+	if err == nil || report.Errors() != 1 {
+		t.Fatalf("expected 1 error, got %v", err)
+	}
+	_, err = os.Stat(filepath.Join(dir, "svc", "server_new.go"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected svc/server_new.go not to be written, got %v", err)
+	}
+}
+
+func TestRewriteInMemory(t *testing.T) {
+	dir := writeReportModule(t)
+	err := os.Remove(filepath.Join(dir, "svc", "bad.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := newTestLogger(io.Discard, slog.LevelWarn)
+	goMod, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, report, err := fxforce5.NewAnalyzer(dir, nil, fxforce5.WithLogger(logger)).Rewrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Errors() != 0 {
+		t.Errorf("expected no errors, got %+v", report.Packages)
+	}
+	newFile := filepath.Join(dir, "svc", "server_new.go")
+	if !bytes.Contains(files[newFile], []byte("ServerParams struct")) {
+		t.Errorf("expected ServerParams in svc/server_new.go, got\n%s", files[newFile])
+	}
+	if !bytes.Contains(files[filepath.Join(dir, "go.mod")], []byte("go.uber.org/fx")) {
+		t.Errorf("expected go.uber.org/fx to be required in go.mod, got\n%s", files[filepath.Join(dir, "go.mod")])
+	}
+	_, err = os.Stat(newFile)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected svc/server_new.go not to be written, got %v", err)
+	}
+	onDisk, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil || !bytes.Equal(onDisk, goMod) {
+		t.Errorf("expected go.mod to be left alone, got %v\n%s", err, onDisk)
+	}
+
+	files, _, err = fxforce5.NewAnalyzer(dir, nil, fxforce5.WithLogger(logger), fxforce5.WithTransformations(fxforce5.TRANSFORM_GROUPS)).Rewrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := files[filepath.Join(dir, "go.mod")]; ok || files[newFile] == nil {
+		t.Errorf("expected svc/server_new.go without go.mod, got %d files", len(files))
+	}
+}
+
+func TestParseTransformation(t *testing.T) {
+	for _, expected := range fxforce5.TRANSFORMATIONS {
+		parsed, err := fxforce5.ParseTransformation(string(expected))
+		if err != nil || parsed != expected {
+			t.Errorf("expected %q to parse as %s, got %q, %v", expected, expected, parsed, err)
+		}
+	}
+	_, err := fxforce5.ParseTransformation("go_mod")
+	if err == nil || !strings.Contains(err.Error(), "go-mod") {
+		t.Errorf("expected an error listing the transformations, got %v", err)
+	}
+}
+
+func TestLoadModel(t *testing.T) {
+	dir := writeReportModule(t)
+	err := os.Remove(filepath.Join(dir, "svc", "bad.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := newTestLogger(io.Discard, slog.LevelWarn)
+	a := fxforce5.NewAnalyzer(dir, nil, fxforce5.WithCacheDir(""), fxforce5.WithLogger(logger))
+	model, err := a.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(model.Packages) != 1 {
+		t.Fatalf("expected 1 package, got %+v", model.Packages)
+	}
+	pkg := model.Packages[0]
+	expectedStructs := []fxforce5.StructModel{{Name: "Server", File: "svc/server.go", Constructor: "NewServer", Fields: []fxforce5.FieldModel{{Name: "Name", Type: "string"}}}}
+	if fmt.Sprint(pkg.Structs) != fmt.Sprint(expectedStructs) {
+		t.Errorf("expected structs %+v, got %+v", expectedStructs, pkg.Structs)
+	}
+	if len(pkg.Constructors) != 1 || pkg.Constructors[0].Name != "NewServer" || !pkg.Constructors[0].Rewritten || !pkg.Constructors[0].Provided {
+		t.Errorf("expected NewServer to be rewritten and provided, got %+v", pkg.Constructors)
+	}
+	if len(pkg.Diagnostics) != 0 {
+		t.Errorf("expected no diagnostics, got %+v", pkg.Diagnostics)
+	}
+	_, err = os.Stat(filepath.Join(dir, "svc", "server_new.go"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected svc/server_new.go not to be written, got %v", err)
+	}
+	if _, err := a.Analyze(); err == nil {
+		t.Error("expected an error running the analyzer again")
+	}
+}
+
+func TestLoadModelLeavesAnalyzerAlone(t *testing.T) {
+	dir := t.TempDir()
+	writeSyntheticGoMod(t, dir)
+	files := map[string]string{
+		"svc/server.go": "package svc\n\ntype DB struct{}\n\ntype Server struct {\n\tPrimary *DB\n\tReplica *DB\n}\n\nfunc NewServer(primary *DB, replica *DB) *Server {\n\treturn &Server{Primary: primary, Replica: replica}\n}\n",
+		"broken/bad.go": "package broken\n\nfunc broken( {\n",
+	}
+	for name, src := range files {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, name), []byte(src), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	logger := newTestLogger(io.Discard, slog.LevelError)
+	a := fxforce5.NewAnalyzer(dir, nil, fxforce5.WithCacheDir(""), fxforce5.WithLogger(logger))
+	// Without WithKeepGoing(), the errors are in the model.
+	model, err := a.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errors := 0
+	for _, p := range model.Packages {
+		errors += len(p.Diagnostics)
+	}
+	if errors != 1 {
+		t.Errorf("expected the error of broken/bad.go, got %+v", model.Packages)
+	}
+	if len(model.NamedDependencies) != 2 {
+		t.Errorf("expected Server.Primary and Server.Replica to be named, got %+v", model.NamedDependencies)
+	}
+	if deps := a.NamedDependencies(); len(deps) != 0 {
+		t.Errorf("expected no named dependency to be emitted by Load(), got %+v", deps)
+	}
+}
+
+func TestAnalyzeCache(t *testing.T) {
+	dir := copyGolden(t, "basic")
+	cacheDir := t.TempDir()
+	logger := newTestLogger(io.Discard, slog.LevelWarn)
+	// Runs fxforce5 and returns whether the svc package was cached.
+	cached := func(opts ...fxforce5.Option) bool {
+		t.Helper()
+		opts = append([]fxforce5.Option{fxforce5.WithCacheDir(cacheDir), fxforce5.WithLogger(logger)}, opts...)
+		report, err := fxforce5.NewAnalyzer(dir, nil, opts...).Analyze()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range report.Packages {
+			if p.Dir == "svc" {
+				return p.Cached
+			}
+		}
+		t.Fatalf("expected the svc package to be analyzed, got %+v", report.Packages)
+		return false
+	}
+
+	if cached() {
+		t.Errorf("expected svc not to be cached on the first run")
+	}
+	if !cached() {
+		t.Errorf("expected svc to be cached when nothing changed")
+	}
+
+	server := filepath.Join(dir, "svc", "server.go")
+	buf, err := os.ReadFile(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(server, append(buf, []byte("\nfunc NewDefaultServer() *Server {\n\treturn NewServerOrig(\"default\", 80)\n}\n")...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached() {
+		t.Errorf("expected svc not to be cached once svc/server.go changed")
+	}
+	if !cached() {
+		t.Errorf("expected svc to be cached again")
+	}
+
+	if cached(fxforce5.WithBuildTags("integration")) {
+		t.Errorf("expected svc not to be cached once the build tags changed")
+	}
+
+	err = os.Remove(filepath.Join(dir, "svc", "server_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached(fxforce5.WithBuildTags("integration")) {
+		t.Errorf("expected svc not to be cached once svc/server_new.go was removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "svc", "server_new.go")); err != nil {
+		t.Errorf("expected svc/server_new.go to be written again, got %v", err)
+	}
+}
+
+func TestAnalyzeDiutilsCopy(t *testing.T) {
+	src, err := diutils.Sources.ReadFile("diutils.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Copy of a diutils file with the header, as written by fxforce5.
+	copyOf := func(body string) string {
+		sum := sha256.Sum256([]byte(body))
+		return fxforce5.DIUTILS_HEADER + "\n" + fxforce5.DIUTILS_HASH_PREFIX + hex.EncodeToString(sum[:]) + "\n\n" + body
+	}
+	oldBody := "package diutils\n\n// Older version.\n"
+	for _, tc := range []struct {
+		name     string
+		existing string
+		// Error expected, "" if none.
+		err string
+		// Content of the file expected after the run.
+		expected string
+	}{
+		{
+			name:     "not written by fxforce5",
+			existing: "package diutils\n\n// Written by hand.\n",
+			err:      "not written by fxforce5",
+			expected: "package diutils\n\n// Written by hand.\n",
+		},
+		{
+			name:     "modified",
+			existing: strings.Replace(copyOf(oldBody), "Older", "Modified", 1),
+			err:      "modified since written by fxforce5",
+			expected: strings.Replace(copyOf(oldBody), "Older", "Modified", 1),
+		},
+		{
+			name:     "stale",
+			existing: copyOf(oldBody),
+			expected: copyOf(string(src)),
+		},
+		{
+			name:     "up to date",
+			existing: copyOf(string(src)),
+			expected: copyOf(string(src)),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := copyGolden(t, "basic")
+			path := filepath.Join(dir, "diutils", "diutils.go")
+			err := os.MkdirAll(filepath.Dir(path), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(path, []byte(tc.existing), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			logger := newTestLogger(io.Discard, slog.LevelWarn)
+			_, err = fxforce5.NewAnalyzer(dir, nil, fxforce5.WithCacheDir(""), fxforce5.WithLogger(logger)).Analyze()
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatal(err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Fatalf("expected an error about a diutils file %s, got %v", tc.err, err)
+			}
+			buf, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != tc.expected {
+				t.Errorf("expected diutils/diutils.go to be\n%s\ngot\n%s", tc.expected, buf)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+module example.com/aliased
+
+go 1.21
+
+require go.uber.org/fx v1.20.1
+
+require (
+	go.uber.org/atomic v1.7.0 // indirect
+	go.uber.org/dig v1.17.0 // indirect
+	go.uber.org/multierr v1.6.0 // indirect
+	go.uber.org/zap v1.23.0 // indirect
+	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad // indirect
+)
@@ -0,0 +1,16 @@
+package svc
+
+import (
+	"strings"
+
+	fxx "go.uber.org/fx"
+)
+
+type Server struct {
+	Name      string
+	Lifecycle fxx.Lifecycle
+}
+
+func NewServer(name string, lc fxx.Lifecycle) *Server {
+	return &Server{Name: strings.ToLower(name), Lifecycle: lc}
+}
@@ -0,0 +1,10 @@
+package svc
+
+type Server struct {
+	Name string
+	Port int
+}
+
+func NewServer(name string, port int) *Server {
+	return &Server{Name: name, Port: port}
+}
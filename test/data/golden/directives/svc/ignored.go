@@ -0,0 +1,11 @@
+//fxforce5:ignore-file
+
+package svc
+
+type Ignored struct {
+	name string
+}
+
+func NewIgnored(name string) *Ignored {
+	return &Ignored{name: name}
+}
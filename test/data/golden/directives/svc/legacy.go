@@ -0,0 +1,6 @@
+package svc
+
+// Legacy is marked with the skip directive in store.go.
+func NewLegacy(db *DB) *Legacy {
+	return &Legacy{db: db}
+}
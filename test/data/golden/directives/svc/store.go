@@ -0,0 +1,39 @@
+package svc
+
+type DB struct{}
+
+type Tracer struct{}
+
+// Store is provided by its implementations.
+type Store interface {
+	Get(key string) string
+}
+
+type SQLStore struct {
+	//fxforce5:name=primary
+	db     *DB
+	tracer *Tracer //fxforce5:optional
+}
+
+//fxforce5:as=Store
+func NewSQLStore(db *DB, tracer *Tracer) *SQLStore {
+	return &SQLStore{db: db, tracer: tracer}
+}
+
+func (s *SQLStore) Get(key string) string {
+	return key
+}
+
+type Handler struct {
+	store Store
+}
+
+//fxforce5:group=routes
+func NewHandler(store Store) *Handler {
+	return &Handler{store: store}
+}
+
+//fxforce5:skip
+type Legacy struct {
+	db *DB
+}
@@ -0,0 +1,20 @@
+package svc
+
+import "errors"
+
+type Client struct {
+	Addr string
+}
+
+type Health struct {
+	Client *Client
+}
+
+// Constructs Client along with Health, so Client gets no params struct.
+func NewClientAndHealth(addr string) (*Client, *Health, error) {
+	if addr == "" {
+		return nil, nil, errors.New("no address")
+	}
+	client := &Client{Addr: addr}
+	return client, &Health{Client: client}, nil
+}
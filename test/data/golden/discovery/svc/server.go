@@ -0,0 +1,23 @@
+package svc
+
+type Config struct {
+	Addr string
+}
+
+type Server struct {
+	Addr string
+}
+
+// Constructs Server, although it is not named NewServer.
+func NewServerFromConfig(cfg Config) *Server {
+	return &Server{Addr: cfg.Addr}
+}
+
+type Digest struct {
+	Items []string
+}
+
+// Not a constructor: New is followed by a lower-case letter.
+func Newsletter(items []string) *Digest {
+	return &Digest{Items: items}
+}
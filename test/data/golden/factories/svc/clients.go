@@ -0,0 +1,34 @@
+package svc
+
+import "errors"
+
+type Config struct {
+	Addr string
+	Rate int
+}
+
+type Client struct {
+	addr string
+}
+
+type ClientFactory struct {
+	prefix string
+}
+
+func (f *ClientFactory) NewClient(cfg Config) (*Client, error) {
+	if cfg.Addr == "" {
+		return nil, errors.New("no address")
+	}
+	return &Client{addr: f.prefix + cfg.Addr}, nil
+}
+
+// Clients is supplied to fx, as ClientFactory has no constructor.
+var Clients = &ClientFactory{prefix: "tcp://"}
+
+type Limiter struct {
+	rate int
+}
+
+var NewLimiter = func(cfg Config) *Limiter {
+	return &Limiter{rate: cfg.Rate}
+}
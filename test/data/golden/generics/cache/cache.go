@@ -0,0 +1,14 @@
+package cache
+
+type Cache[K comparable, V any] struct {
+	entries map[K]V
+}
+
+func NewCache[K comparable, V any]() *Cache[K, V] {
+	return &Cache[K, V]{entries: make(map[K]V)}
+}
+
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	v, ok := c.entries[key]
+	return v, ok
+}
@@ -0,0 +1,26 @@
+package svc
+
+import "example.com/generics/cache"
+
+type User struct {
+	Name string
+}
+
+// NewCache is not provided for Cache[int, User], as package cache cannot
+// import User.
+type Users struct {
+	byID   *cache.Cache[int, User]
+	counts *cache.Cache[string, int]
+}
+
+func NewUsers(byID *cache.Cache[int, User]) *Users {
+	return &Users{byID: byID, counts: cache.NewCache[string, int]()}
+}
+
+type Sessions struct {
+	active *cache.Cache[int, bool]
+}
+
+func NewSessions(active *cache.Cache[int, bool]) *Sessions {
+	return &Sessions{active: active}
+}
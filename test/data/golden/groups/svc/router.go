@@ -0,0 +1,17 @@
+package svc
+
+import "net/http"
+
+// Router mounts all the routes.
+type Router struct {
+	mux    *http.ServeMux
+	routes []Route
+}
+
+func NewRouter(routes []Route) *Router {
+	r := &Router{mux: http.NewServeMux(), routes: routes}
+	for _, route := range routes {
+		r.mux.Handle(route.Pattern(), route)
+	}
+	return r
+}
@@ -0,0 +1,41 @@
+package svc
+
+import "net/http"
+
+// Route is an http handler mounted at a pattern.
+type Route interface {
+	http.Handler
+	Pattern() string
+}
+
+type HealthHandler struct {
+	status string
+}
+
+func NewHealthHandler() *HealthHandler {
+	return &HealthHandler{status: "ok"}
+}
+
+func (h *HealthHandler) Pattern() string {
+	return "/health"
+}
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(h.status))
+}
+
+type EchoHandler struct {
+	prefix string
+}
+
+func NewEchoHandler(prefix string) *EchoHandler {
+	return &EchoHandler{prefix: prefix}
+}
+
+func (h *EchoHandler) Pattern() string {
+	return "/echo"
+}
+
+func (h *EchoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(h.prefix + r.URL.Path))
+}
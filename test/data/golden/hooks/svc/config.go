@@ -0,0 +1,38 @@
+package svc
+
+import (
+	"errors"
+	"time"
+)
+
+type Config struct {
+	Addr    string
+	Timeout time.Duration `default:"5s"`
+}
+
+func NewConfig(addr string) Config {
+	return Config{Addr: addr}
+}
+
+type Server struct {
+	Config Config
+}
+
+func (s *Server) Validate() error {
+	if s.Config.Addr == "" {
+		return errors.New("no address")
+	}
+	return nil
+}
+
+func NewServer(cfg Config) *Server {
+	return &Server{Config: cfg}
+}
+
+type Plain struct {
+	Name string
+}
+
+func NewPlain(name string) *Plain {
+	return &Plain{Name: name}
+}
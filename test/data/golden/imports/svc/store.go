@@ -0,0 +1,11 @@
+package svc
+
+import "example.com/imports/db"
+
+type Store struct {
+	db *db.DB
+}
+
+func NewStore(db *db.DB) *Store {
+	return &Store{db: db}
+}
@@ -0,0 +1,41 @@
+package svc
+
+import "context"
+
+type Logger struct{}
+
+func NewLogger() *Logger {
+	return &Logger{}
+}
+
+// Server has a lifecycle field of its own, exported as Lifecycle in
+// ServerParams.
+type Server struct {
+	logger    *Logger
+	lifecycle string
+}
+
+func NewServer(logger *Logger) *Server {
+	return &Server{logger: logger}
+}
+
+func (s *Server) Start(ctx context.Context) error {
+	return nil
+}
+
+func (s *Server) Stop(ctx context.Context) error {
+	return nil
+}
+
+// Worker only has a Close method.
+type Worker struct {
+	logger *Logger
+}
+
+func NewWorker(logger *Logger) *Worker {
+	return &Worker{logger: logger}
+}
+
+func (w *Worker) Close() error {
+	return nil
+}
@@ -0,0 +1,9 @@
+package db
+
+type DB struct {
+	dsn string
+}
+
+func Open(dsn string) *DB {
+	return &DB{dsn: dsn}
+}
@@ -0,0 +1,21 @@
+package svc
+
+import "example.com/named/db"
+
+func NewPrimary() *db.DB {
+	return db.Open("primary")
+}
+
+func NewReplica() *db.DB {
+	return db.Open("replica")
+}
+
+// Store reads from the replica and writes to the primary.
+type Store struct {
+	Primary *db.DB
+	Replica *db.DB
+}
+
+func NewStore(primary *db.DB, replica *db.DB) *Store {
+	return &Store{Primary: primary, Replica: replica}
+}
@@ -0,0 +1,9 @@
+package svc
+
+type Server struct {
+	Name string
+}
+
+func NewServer(name string) *Server {
+	return &Server{Name: name}
+}
@@ -0,0 +1,10 @@
+package gen
+
+// Generator is in the nested module example.com/outer/tools.
+type Generator struct {
+	Dir string
+}
+
+func NewGenerator(dir string) *Generator {
+	return &Generator{Dir: dir}
+}
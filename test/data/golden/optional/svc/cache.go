@@ -0,0 +1,29 @@
+package svc
+
+type Store struct{}
+
+type Tracer struct{}
+
+func (t *Tracer) Trace(key string) {}
+
+type Metrics interface {
+	Inc(name string)
+}
+
+type Cache struct {
+	store   *Store
+	metrics Metrics
+	//fxforce5:optional
+	Tracer *Tracer
+}
+
+func NewCache(store *Store, metrics Metrics, tracer *Tracer) *Cache {
+	return &Cache{store: store, metrics: metrics, Tracer: tracer}
+}
+
+func (c *Cache) Get(key string) {
+	if c.metrics != nil {
+		c.metrics.Inc("get")
+	}
+	c.Tracer.Trace(key)
+}
@@ -0,0 +1,5 @@
+module example.com/platforms
+
+go 1.21
+
+require go.uber.org/fx v1.20.1
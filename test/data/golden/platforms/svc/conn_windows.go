@@ -0,0 +1,9 @@
+package svc
+
+type Conn struct {
+	addr string
+}
+
+func NewConn() *Conn {
+	return &Conn{addr: `\\.\pipe\svc`}
+}
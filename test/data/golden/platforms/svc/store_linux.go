@@ -0,0 +1,10 @@
+package svc
+
+// Cache keeps the suffix of its file name, as store.go declares SvcStore.
+type Cache struct {
+	dir string
+}
+
+func NewCache(dir string) *Cache {
+	return &Cache{dir: dir}
+}
@@ -0,0 +1,27 @@
+package svc
+
+type Client struct {
+	Addr string
+}
+
+type Health struct {
+	Client *Client
+}
+
+type Metrics struct {
+	Client *Client
+}
+
+func NewClientAndHealth(addr string) (*Client, *Health, error) {
+	client := &Client{Addr: addr}
+	return client, &Health{Client: client}, nil
+}
+
+func NewMetricsAndHealth(client *Client) (Metrics, Health) {
+	return Metrics{Client: client}, Health{Client: client}
+}
+
+// Returns *Client twice, which fx cannot provide.
+func NewClientPair(addr string) (*Client, *Client) {
+	return &Client{Addr: addr}, &Client{Addr: addr}
+}
@@ -0,0 +1,9 @@
+package api
+
+type Handler struct {
+	Prefix string
+}
+
+func NewHandler(prefix string) *Handler {
+	return &Handler{Prefix: prefix}
+}
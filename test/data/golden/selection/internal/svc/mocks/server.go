@@ -0,0 +1,10 @@
+package mocks
+
+// MockServer is excluded with internal/**/mocks/*.go.
+type MockServer struct {
+	Calls int
+}
+
+func NewMockServer(calls int) *MockServer {
+	return &MockServer{Calls: calls}
+}
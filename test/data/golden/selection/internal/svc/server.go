@@ -0,0 +1,9 @@
+package svc
+
+type Server struct {
+	Addr string
+}
+
+func NewServer(addr string) *Server {
+	return &Server{Addr: addr}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package svc
+
+type Conn struct {
+	socket string
+}
+
+func NewConn() *Conn {
+	return &Conn{socket: "/run/svc.sock"}
+}
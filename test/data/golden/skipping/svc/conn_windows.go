@@ -0,0 +1,12 @@
+//go:build windows
+
+package svc
+
+// Conn is rewritten though it is not in the build on Linux.
+type Conn struct {
+	pipe string
+}
+
+func NewConn() *Conn {
+	return &Conn{pipe: `\\.\pipe\svc`}
+}
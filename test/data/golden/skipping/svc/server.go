@@ -0,0 +1,9 @@
+package svc
+
+type Server struct {
+	conn *Conn
+}
+
+func NewServer(conn *Conn) *Server {
+	return &Server{conn: conn}
+}
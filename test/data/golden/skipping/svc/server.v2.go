@@ -0,0 +1,10 @@
+package svc
+
+// The rewritten file is server.v2_new.go.
+type ServerV2 struct {
+	server *Server
+}
+
+func NewServerV2(server *Server) *ServerV2 {
+	return &ServerV2{server: server}
+}
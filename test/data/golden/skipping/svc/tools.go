@@ -0,0 +1,11 @@
+//go:build ignore
+
+package svc
+
+type Tool struct {
+	server *Server
+}
+
+func NewTool(server *Server) *Tool {
+	return &Tool{server: server}
+}
@@ -0,0 +1,13 @@
+package svc_test
+
+import (
+	"fmt"
+
+	"example.com/testfiles/svc"
+)
+
+func ExampleNewServer() {
+	s := svc.NewServer(":8080")
+	fmt.Println(s.Addr)
+	// Output: :8080
+}
@@ -0,0 +1,10 @@
+package svc
+
+import "testing"
+
+func TestNewServer(t *testing.T) {
+	s := NewServer(":8080")
+	if s.Addr != ":8080" {
+		t.Errorf("expected :8080, got %s", s.Addr)
+	}
+}
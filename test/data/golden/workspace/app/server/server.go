@@ -0,0 +1,12 @@
+package server
+
+import "example.com/lib/store"
+
+// Server depends on a type of another module of the workspace.
+type Server struct {
+	store *store.Store
+}
+
+func NewServer(store *store.Store) *Server {
+	return &Server{store: store}
+}
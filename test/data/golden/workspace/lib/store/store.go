@@ -0,0 +1,9 @@
+package store
+
+type Store struct {
+	dsn string
+}
+
+func NewStore(dsn string) *Store {
+	return &Store{dsn: dsn}
+}
@@ -0,0 +1,10 @@
+package job
+
+// Job is in a module not used by the workspace, and left alone.
+type Job struct {
+	Name string
+}
+
+func NewJob(name string) *Job {
+	return &Job{Name: name}
+}
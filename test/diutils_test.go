@@ -1,7 +1,11 @@
 package test
 
 import (
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/debedb/fxforce5/diutils"
 	"go.uber.org/fx"
@@ -50,3 +54,241 @@ func TestNoPtrRetval(t *testing.T) {
 		t.Errorf("Expected foo, got %s", f.Name)
 	}
 }
+
+type DB struct {
+	Name string
+}
+
+type Store struct {
+	name    string
+	primary *DB
+	dbs     map[string]*DB
+	Ignored string
+}
+
+type StoreParams struct {
+	fx.In
+
+	Name      string `diutils:"target=name"`
+	PrimaryDB *DB    `diutils:"target=primary"`
+	ReplicaDB *DB    `diutils:"target=dbs,key=replica"`
+	BackupDB  *DB    `diutils:"target=dbs,key=backup"`
+	Ignored   string `diutils:"-"`
+}
+
+func TestTaggedFields(t *testing.T) {
+	primary := &DB{Name: "primary"}
+	replica := &DB{Name: "replica"}
+	backup := &DB{Name: "backup"}
+	s := diutils.Construct[StoreParams, Store](StoreParams{
+		Name:      "store",
+		PrimaryDB: primary,
+		ReplicaDB: replica,
+		BackupDB:  backup,
+		Ignored:   "ignored",
+	})
+	if s.name != "store" {
+		t.Errorf("Expected store, got %s", s.name)
+	}
+	if s.primary != primary {
+		t.Errorf("Expected primary DB, got %+v", s.primary)
+	}
+	if s.dbs["replica"] != replica || s.dbs["backup"] != backup {
+		t.Errorf("Expected replica and backup DBs, got %+v", s.dbs)
+	}
+	if s.Ignored != "" {
+		t.Errorf("Expected Ignored to be skipped, got %s", s.Ignored)
+	}
+}
+
+type BadTagParams struct {
+	fx.In
+
+	Name string `diutils:"target"`
+}
+
+func TestMalformedTag(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected panic on malformed tag")
+		}
+	}()
+	diutils.Construct[BadTagParams, Store](BadTagParams{Name: "store"})
+}
+
+func TestDeconstructPtr(t *testing.T) {
+	f := NewFoo(FooParams{Name: "foo"})
+	fp := diutils.Deconstruct[Foo, FooParams](f)
+	if fp.Name != "foo" {
+		t.Errorf("Expected foo, got %s", fp.Name)
+	}
+	if f2 := NewFoo(fp); !reflect.DeepEqual(f, f2) {
+		t.Errorf("Expected %+v, got %+v", f, f2)
+	}
+}
+
+func TestDeconstructVal(t *testing.T) {
+	b := NewBar(BarParams{Name: "bar"})
+	bp := diutils.DeconstructVal[Bar, BarParams](b)
+	if bp.Name != "bar" {
+		t.Errorf("Expected bar, got %s", bp.Name)
+	}
+	if b2 := NewBar(bp); !reflect.DeepEqual(b, b2) {
+		t.Errorf("Expected %+v, got %+v", b, b2)
+	}
+}
+
+func TestDeconstructTaggedFields(t *testing.T) {
+	s := diutils.Construct[StoreParams, Store](StoreParams{
+		Name:      "store",
+		PrimaryDB: &DB{Name: "primary"},
+		ReplicaDB: &DB{Name: "replica"},
+		BackupDB:  &DB{Name: "backup"},
+	})
+	sp := diutils.Deconstruct[Store, StoreParams](s)
+	if sp.Name != "store" || sp.PrimaryDB.Name != "primary" ||
+		sp.ReplicaDB.Name != "replica" || sp.BackupDB.Name != "backup" {
+		t.Errorf("Unexpected params: %+v", sp)
+	}
+	if s2 := diutils.Construct[StoreParams, Store](sp); !reflect.DeepEqual(s, s2) {
+		t.Errorf("Expected %+v, got %+v", s, s2)
+	}
+}
+
+type Config struct {
+	Addr    string        `default:"localhost:8080"`
+	Timeout time.Duration `default:"5s"`
+	Retries int           `default:"3"`
+	Verbose bool          `default:"true"`
+	Ratio   float64       `default:"0.5"`
+	Tags    []string
+}
+
+func (c *Config) SetDefaults() {
+	if c.Tags == nil {
+		c.Tags = []string{"default"}
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.Retries < 0 {
+		return errors.New("retries must not be negative")
+	}
+	return nil
+}
+
+type ConfigParams struct {
+	fx.In
+
+	Addr    string
+	Retries int
+}
+
+func TestDefaults(t *testing.T) {
+	c := diutils.Construct[ConfigParams, Config](ConfigParams{Addr: "example.com:80"})
+	expected := &Config{
+		Addr:    "example.com:80",
+		Timeout: 5 * time.Second,
+		Retries: 3,
+		Verbose: true,
+		Ratio:   0.5,
+		Tags:    []string{"default"},
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, c)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	_, err := diutils.ConstructValErr[ConfigParams, Config](ConfigParams{Retries: -1})
+	if err == nil {
+		t.Fatalf("Expected validation error")
+	}
+	if !strings.Contains(err.Error(), "retries must not be negative") {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected panic on validation error")
+		}
+	}()
+	diutils.Construct[ConfigParams, Config](ConfigParams{Retries: -1})
+}
+
+type BadDefault struct {
+	Retries int `default:"three"`
+}
+
+func TestBadDefault(t *testing.T) {
+	_, err := diutils.ConstructErr[ConfigParams, BadDefault](ConfigParams{})
+	if err == nil {
+		t.Errorf("Expected error for bad default")
+	}
+}
+
+type Client struct {
+	Addr string
+}
+
+type HealthChecker struct {
+	Client *Client
+}
+
+type ClientResult struct {
+	fx.Out
+
+	Client        *Client
+	HealthChecker *HealthChecker
+}
+
+func NewClientOrig(addr string) (*Client, *HealthChecker, error) {
+	if addr == "" {
+		return nil, nil, errors.New("no address")
+	}
+	c := &Client{Addr: addr}
+	return c, &HealthChecker{Client: c}, nil
+}
+
+func NewClient(addr string) (ClientResult, error) {
+	return diutils.OutErr[ClientResult](NewClientOrig(addr))
+}
+
+func TestOut(t *testing.T) {
+	var c *Client
+	var hc *HealthChecker
+	app := fx.New(
+		fx.Supply("localhost:8080"),
+		fx.Provide(NewClient),
+		fx.Populate(&c, &hc),
+		fx.NopLogger,
+	)
+	if err := app.Err(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if c.Addr != "localhost:8080" || hc.Client != c {
+		t.Errorf("Unexpected results: %+v, %+v", c, hc)
+	}
+
+	_, err := NewClient("")
+	if err == nil {
+		t.Errorf("Expected error")
+	}
+
+	r := diutils.Out[ClientResult](c, hc)
+	if r.Client != c || r.HealthChecker != hc {
+		t.Errorf("Unexpected result: %+v", r)
+	}
+}
+
+func TestSources(t *testing.T) {
+	for _, name := range []string{"diutils.go", "hooks.go", "out.go"} {
+		src, err := diutils.Sources.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Missing %s: %s", name, err)
+		}
+		if !strings.HasPrefix(string(src), "// Utils for") && !strings.HasPrefix(string(src), "package diutils") {
+			t.Errorf("Unexpected start of %s: %.40q", name, src)
+		}
+	}
+}
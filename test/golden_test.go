@@ -0,0 +1,639 @@
+package test
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/debedb/fxforce5/fxforce5"
+)
+
+// Golden tests run fxforce5 on a copy of a module under data/golden, and
+// compare the rewritten files and the go.mod and go.sum files it writes
+// with the .golden files of the module, e.g. svc/server_new.go with
+// svc/server_new.go.golden. Run them with -update to write the .golden
+// files.
+var update = flag.Bool("update", false, "write the .golden files of the golden tests")
+
+// Copy the module under data/golden to a temporary directory, without its
+// .golden files. Returns the directory.
+func copyGolden(t *testing.T, name string) string {
+	src := filepath.Join("data", "golden", name)
+	dir := t.TempDir()
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dir, rel), 0755)
+		}
+		if strings.HasSuffix(path, ".golden") {
+			return nil
+		}
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, rel), buf, 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Run fxforce5 on a copy of the module under data/golden with the options,
+// and compare what it wrote with the .golden files. Returns the directory
+// of the copy and the report.
+func runGolden(t *testing.T, name string, opts ...fxforce5.Option) (string, *fxforce5.Report) {
+	t.Helper()
+	dir := copyGolden(t, name)
+	opts = append([]fxforce5.Option{fxforce5.WithCacheDir(""), fxforce5.WithLogger(newTestLogger(io.Discard, slog.LevelWarn))}, opts...)
+	report, err := fxforce5.NewAnalyzer(dir, nil, opts...).Analyze()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, name, dir)
+	return dir, report
+}
+
+// Compare the files written under dir with the .golden files of the module
+// under data/golden.
+func checkGolden(t *testing.T, name string, dir string) {
+	t.Helper()
+	src := filepath.Join("data", "golden", name)
+	written := writtenFiles(t, src, dir)
+	expected := make([]string, 0)
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !strings.HasSuffix(path, ".golden") {
+			return err
+		}
+		rel, err := filepath.Rel(src, strings.TrimSuffix(path, ".golden"))
+		expected = append(expected, rel)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		for _, path := range expected {
+			os.Remove(filepath.Join(src, path+".golden"))
+		}
+		for _, path := range written {
+			buf, err := os.ReadFile(filepath.Join(dir, path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(filepath.Join(src, path+".golden"), buf, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return
+	}
+	sort.Strings(expected)
+	if strings.Join(written, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected %v to be written, got %v", expected, written)
+	}
+	for _, path := range written {
+		buf, err := os.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		golden, err := os.ReadFile(filepath.Join(src, path+".golden"))
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(buf, golden) {
+			t.Errorf("%s differs from %s.golden, got\n%s", path, path, buf)
+		}
+	}
+}
+
+// Returns the rewritten files under dir, and the go.mod and go.sum files
+// changed from those under src, relative to dir and sorted.
+func writtenFiles(t *testing.T, src string, dir string) []string {
+	written := make([]string, 0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasSuffix(path, "_new.go"), strings.HasSuffix(path, "_new_test.go"):
+			written = append(written, rel)
+		case info.Name() == "go.mod", info.Name() == "go.sum":
+			buf, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			orig, err := os.ReadFile(filepath.Join(src, rel))
+			if err != nil || !bytes.Equal(buf, orig) {
+				written = append(written, rel)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(written)
+	return written
+}
+
+func TestGoldenProvidesRewrittenConstructor(t *testing.T) {
+	dir, _ := runGolden(t, "basic")
+	buf, err := os.ReadFile(filepath.Join(dir, "svc", "server_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf, []byte("fx.Provide(NewServer)")) || bytes.Contains(buf, []byte("fx.Provide(NewServerOrig)")) {
+		t.Errorf("expected the generated NewServer to be provided, got\n%s", buf)
+	}
+}
+
+func TestGoldenAliasedFxImport(t *testing.T) {
+	dir, _ := runGolden(t, "aliased")
+	buf, err := os.ReadFile(filepath.Join(dir, "svc", "server_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf, []byte("fxx.In")) || !bytes.Contains(buf, []byte("fxx.Module(")) || bytes.Contains(buf, []byte("\"go.uber.org/fx\"\n\t\"go.uber.org/fx\"")) {
+		t.Errorf("expected fx to be referred to as fxx, got\n%s", buf)
+	}
+}
+
+func TestGoldenConstructorDiscovery(t *testing.T) {
+	dir, report := runGolden(t, "discovery")
+	names := make([]string, 0)
+	for _, ctor := range report.Packages[0].Constructors {
+		names = append(names, ctor.Name)
+	}
+	if strings.Join(names, " ") != "NewClientAndHealth NewServerFromConfig" {
+		t.Errorf("expected NewClientAndHealth and NewServerFromConfig to be constructors, got %v", names)
+	}
+	buf, err := os.ReadFile(filepath.Join(dir, "svc", "client_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf, []byte("ClientParams")) {
+		t.Errorf("expected no params struct for Client, constructed with several results, got\n%s", buf)
+	}
+}
+
+func TestGoldenResultStructs(t *testing.T) {
+	dir, report := runGolden(t, "results")
+	buf, err := os.ReadFile(filepath.Join(dir, "svc", "client_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"NewClientAndHealthResult struct", "NewMetricsAndHealthResult struct"} {
+		if !bytes.Contains(buf, []byte(name)) {
+			t.Errorf("expected %s, got\n%s", name, buf)
+		}
+	}
+	diagnostics := report.Packages[0].Diagnostics
+	if len(diagnostics) != 1 || diagnostics[0].Severity != fxforce5.SEVERITY_WARNING || diagnostics[0].Code != fxforce5.DIAG_RESULT_TYPE || diagnostics[0].Pos.Line != 25 {
+		t.Errorf("expected a warning about NewClientPair at svc/client.go:25, got %+v", diagnostics)
+	}
+}
+
+func TestGoldenConstructErr(t *testing.T) {
+	dir, _ := runGolden(t, "hooks")
+	buf, err := os.ReadFile(filepath.Join(dir, "svc", "config_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"func NewConfig(params ConfigParams) (Config, error)",
+		"diutils.ConstructValErr[ConfigParams, Config](params)",
+		"func NewServer(params ServerParams) (*Server, error)",
+		"diutils.ConstructErr[ServerParams, Server](params)",
+		"func NewPlain(params PlainParams) *Plain",
+	} {
+		if !bytes.Contains(buf, []byte(expected)) {
+			t.Errorf("expected %s, got\n%s", expected, buf)
+		}
+	}
+}
+
+func TestGoldenLifecycleHooks(t *testing.T) {
+	dir, _ := runGolden(t, "lifecycle")
+	buf, err := os.ReadFile(filepath.Join(dir, "svc", "server_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"FxLifecycle fx.Lifecycle",
+		"params.FxLifecycle.Append(fx.Hook{",
+		"OnStart: retval.Start",
+		"OnStop:  retval.Stop",
+		"Lifecycle fx.Lifecycle",
+		"return retval.Close()",
+	} {
+		if !bytes.Contains(buf, []byte(expected)) {
+			t.Errorf("expected %s, got\n%s", expected, buf)
+		}
+	}
+}
+
+func TestGoldenSkipsGeneratedAndIgnoredFiles(t *testing.T) {
+	dir, report := runGolden(t, "skipping")
+	buf, err := os.ReadFile(filepath.Join(dir, "svc", "server.v2_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf, []byte("var SvcServerV2 = ")) {
+		t.Errorf("expected the module of server.v2.go to be SvcServerV2, got\n%s", buf)
+	}
+	skipped := make([]string, 0)
+	for _, s := range report.Packages[0].Skipped {
+		skipped = append(skipped, s.Path+": "+s.Reason)
+	}
+	sort.Strings(skipped)
+	expected := []string{
+		"svc/tools.go: excluded by build constraint ignore",
+		"svc/zz_generated.go: generated",
+	}
+	if strings.Join(skipped, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected %v to be skipped, got %v", expected, skipped)
+	}
+}
+
+func TestGoldenPlatformVariants(t *testing.T) {
+	dir, _ := runGolden(t, "platforms")
+	// The variants of a file for different platforms declare the same
+	// module, so that it can be referred to on any platform.
+	for _, name := range []string{"conn_linux_new.go", "conn_windows_new.go", "conn_darwin_arm64_new.go"} {
+		buf, err := os.ReadFile(filepath.Join(dir, "svc", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(buf, []byte("var SvcConn = fx.Module(\"SvcConn\"")) {
+			t.Errorf("expected %s to declare SvcConn, got\n%s", name, buf)
+		}
+	}
+	buf, err := os.ReadFile(filepath.Join(dir, "svc", "store_linux_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf, []byte("var SvcStore_linux = ")) {
+		t.Errorf("expected store_linux.go to keep its suffix, got\n%s", buf)
+	}
+}
+
+func TestGoldenTestFiles(t *testing.T) {
+	dir, _ := runGolden(t, "testfiles", fxforce5.WithTestFiles(fxforce5.TEST_FILES_UPDATE))
+	for name, call := range map[string]string{"server_new_test.go": "NewServerOrig(\":8080\")", "example_new_test.go": "svc.NewServerOrig(\":8080\")"} {
+		buf, err := os.ReadFile(filepath.Join(dir, "svc", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(buf, []byte(call)) {
+			t.Errorf("expected %s to call %s, got\n%s", name, call, buf)
+		}
+	}
+	// The updated test files build and pass once they replace the original
+	// ones, along with the rewritten files.
+	replaceOriginals(t, dir)
+	cmd := exec.Command("go", "test", "./...")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("expected the tests of the rewritten module to pass, got %v\n%s", err, out)
+	}
+}
+
+// Replace the files under dir with their rewritten versions, e.g. x.go with
+// x_new.go and x_test.go with x_new_test.go.
+func replaceOriginals(t *testing.T, dir string) {
+	t.Helper()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		switch {
+		case strings.HasSuffix(path, "_new_test.go"):
+			return os.Rename(path, strings.TrimSuffix(path, "_new_test.go")+"_test.go")
+		case strings.HasSuffix(path, "_new.go"):
+			return os.Rename(path, strings.TrimSuffix(path, "_new.go")+".go")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoldenGoModRequires(t *testing.T) {
+	dir, _ := runGolden(t, "basic")
+	goMod, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	goSum, err := os.ReadFile(filepath.Join(dir, "go.sum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(goMod, []byte("require go.uber.org/fx v1.20.1\n")) || !bytes.Contains(goMod, []byte("\tgo.uber.org/zap v1.23.0 // indirect\n")) {
+		t.Errorf("expected go.uber.org/fx to be required, and go.uber.org/zap indirectly, got\n%s", goMod)
+	}
+	// Without the content of the modules fx imports, the build fails with
+	// "missing go.sum entry".
+	for _, sum := range []string{"go.uber.org/fx v1.20.1 h1:", "go.uber.org/dig v1.17.0 h1:", "go.uber.org/zap v1.23.0/go.mod h1:"} {
+		if !bytes.Contains(goSum, []byte(sum)) {
+			t.Errorf("expected %s in go.sum, got\n%s", sum, goSum)
+		}
+	}
+}
+
+func TestGoldenValueGroups(t *testing.T) {
+	dir, _ := runGolden(t, "groups", fxforce5.WithGroupRule(fxforce5.GroupRule{Interface: "Route", Group: "routes"}))
+	routes, err := os.ReadFile(filepath.Join(dir, "svc", "routes_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ctor := range []string{"NewHealthHandler", "NewEchoHandler"} {
+		expected := "fx.Provide(fx.Annotate(" + ctor + ", fx.As(new(Route)), fx.ResultTags(`group:\"routes\"`)))"
+		if !bytes.Contains(routes, []byte(expected)) {
+			t.Errorf("expected %s, got\n%s", expected, routes)
+		}
+	}
+	router, err := os.ReadFile(filepath.Join(dir, "svc", "router_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(router, []byte("Routes []Route        `diutils:\"target=routes\" group:\"routes\"`")) {
+		t.Errorf("expected the routes of Router to come from the routes group, got\n%s", router)
+	}
+}
+
+func TestGoldenSingleImport(t *testing.T) {
+	dir, _ := runGolden(t, "imports")
+	buf, err := os.ReadFile(filepath.Join(dir, "svc", "store_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf, []byte("import (\n\t\"example.com/imports/db\"\n\t\"example.com/imports/diutils\"\n\t\"go.uber.org/fx\"\n)\n")) {
+		t.Errorf("expected diutils and fx to be imported along with db, got\n%s", buf)
+	}
+}
+
+func TestGoldenNamedDependencies(t *testing.T) {
+	dir, report := runGolden(t, "named")
+	buf, err := os.ReadFile(filepath.Join(dir, "svc", "store_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"fx.Provide(fx.Annotate(NewPrimary, fx.ResultTags(`name:\"primary\"`)))",
+		"fx.Provide(fx.Annotate(NewReplica, fx.ResultTags(`name:\"replica\"`)))",
+		"Primary *db.DB `name:\"primary\"`",
+		"Replica *db.DB `name:\"replica\"`",
+	} {
+		if !bytes.Contains(buf, []byte(expected)) {
+			t.Errorf("expected %s, got\n%s", expected, buf)
+		}
+	}
+	names := make([]string, 0)
+	for _, dep := range report.NamedDependencies {
+		names = append(names, dep.Struct+"."+dep.Field+"="+dep.Name)
+	}
+	if strings.Join(names, " ") != "Store.Primary=primary Store.Replica=replica" {
+		t.Errorf("expected the names of Store.Primary and Store.Replica to be reported, got %v", names)
+	}
+}
+
+func TestGoldenOptionalFields(t *testing.T) {
+	dir, _ := runGolden(t, "optional")
+	buf, err := os.ReadFile(filepath.Join(dir, "svc", "cache_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"Store   *Store  `diutils:\"target=store\"`",
+		"Metrics Metrics `diutils:\"target=metrics\" optional:\"true\"`",
+		"Tracer  *Tracer `optional:\"true\"`",
+	} {
+		if !bytes.Contains(buf, []byte(expected)) {
+			t.Errorf("expected %s, got\n%s", expected, buf)
+		}
+	}
+}
+
+func TestGoldenDirectives(t *testing.T) {
+	dir, report := runGolden(t, "directives")
+	buf, err := os.ReadFile(filepath.Join(dir, "svc", "store_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"Db     *DB     `diutils:\"target=db\" name:\"primary\"`",
+		"Tracer *Tracer `diutils:\"target=tracer\" optional:\"true\"`",
+		"fx.Provide(fx.Annotate(NewSQLStore, fx.As(new(Store))))",
+		"fx.Provide(fx.Annotate(NewHandler, fx.ResultTags(`group:\"routes\"`)))",
+	} {
+		if !bytes.Contains(buf, []byte(expected)) {
+			t.Errorf("expected %s, got\n%s", expected, buf)
+		}
+	}
+	if bytes.Contains(buf, []byte("LegacyParams")) {
+		t.Errorf("expected Legacy to be skipped, got\n%s", buf)
+	}
+	// The constructor of Legacy is in another file.
+	if _, err := os.Stat(filepath.Join(dir, "svc", "legacy_new.go")); !os.IsNotExist(err) {
+		t.Errorf("expected svc/legacy.go not to be rewritten, got %v", err)
+	}
+	skipped := make([]string, 0)
+	for _, s := range report.Packages[0].Skipped {
+		skipped = append(skipped, s.Path+" "+s.Name)
+	}
+	for _, expected := range []string{"svc/ignored.go ", "svc/legacy.go NewLegacy"} {
+		if !strings.Contains(strings.Join(skipped, "\n")+"\n", expected+"\n") {
+			t.Errorf("expected %s to be skipped, got %+v", expected, report.Packages[0].Skipped)
+		}
+	}
+}
+
+func TestGoldenFactories(t *testing.T) {
+	dir, report := runGolden(t, "factories")
+	buf, err := os.ReadFile(filepath.Join(dir, "svc", "clients_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"func NewClientFromClientFactory(f *ClientFactory, cfg Config) (*Client, error) {\n\treturn f.NewClient(cfg)\n}",
+		"fx.Provide(NewClientFromClientFactory)",
+		"fx.Provide(NewLimiter)",
+		"fx.Supply(Clients)",
+	} {
+		if !bytes.Contains(buf, []byte(expected)) {
+			t.Errorf("expected %s, got\n%s", expected, buf)
+		}
+	}
+	kinds := make([]string, 0)
+	for _, ctor := range report.Packages[0].Constructors {
+		kinds = append(kinds, ctor.Name+"="+string(ctor.Kind))
+	}
+	sort.Strings(kinds)
+	if strings.Join(kinds, " ") != "NewClientFromClientFactory=method NewLimiter=var" {
+		t.Errorf("expected a method and a var constructor, got %v", kinds)
+	}
+}
+
+func TestGoldenGenericInstantiations(t *testing.T) {
+	dir, _ := runGolden(t, "generics")
+	buf, err := os.ReadFile(filepath.Join(dir, "cache", "cache_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf, []byte("fx.Provide(NewCache[int, bool]), fx.Provide(NewCache[string, int])")) || bytes.Contains(buf, []byte("User]")) {
+		t.Errorf("expected NewCache to be provided for [int, bool] and [string, int] only, got\n%s", buf)
+	}
+}
+
+func TestGoldenNestedModules(t *testing.T) {
+	dir, _ := runGolden(t, "nested")
+	buf, err := os.ReadFile(filepath.Join(dir, "tools", "gen", "gen_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf, []byte("\"example.com/outer/tools/diutils\"")) || !bytes.Contains(buf, []byte("var GenGen = ")) {
+		t.Errorf("expected gen.go to be rewritten in module example.com/outer/tools, got\n%s", buf)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tools", "diutils", "diutils.go")); err != nil {
+		t.Errorf("expected a diutils package in module example.com/outer/tools, got %v", err)
+	}
+}
+
+func TestAnalyzeModuleSubdirectory(t *testing.T) {
+	dir := copyGolden(t, "nested")
+	logger := newTestLogger(io.Discard, slog.LevelWarn)
+	_, err := fxforce5.NewAnalyzer(filepath.Join(dir, "svc"), nil, fxforce5.WithCacheDir(""), fxforce5.WithLogger(logger)).Analyze()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Paths are relative to the root of the module, not to the directory.
+	buf, err := os.ReadFile(filepath.Join(dir, "svc", "server_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf, []byte("var SvcServer = fx.Module(\"SvcServer\"")) || !bytes.Contains(buf, []byte("\"example.com/outer/diutils\"")) {
+		t.Errorf("expected svc/server.go to be rewritten relative to the module root, got\n%s", buf)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tools", "gen", "gen_new.go")); !os.IsNotExist(err) {
+		t.Errorf("expected tools/gen/gen.go, outside of the directory, not to be rewritten, got %v", err)
+	}
+}
+
+func TestGoldenWorkspace(t *testing.T) {
+	// -mod=mod is not allowed in workspace mode, see
+	// TestAnalyzeReportsLoadErrors.
+	t.Setenv("GOFLAGS", "")
+	dir, _ := runGolden(t, "workspace")
+	buf, err := os.ReadFile(filepath.Join(dir, "app", "server", "server_new.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf, []byte("\"example.com/app/diutils\"")) || !bytes.Contains(buf, []byte("Store *store.Store `diutils:\"target=store\"`")) {
+		t.Errorf("expected server.go to be rewritten in module example.com/app, got\n%s", buf)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other", "job", "job_new.go")); !os.IsNotExist(err) {
+		t.Errorf("expected other/job/job.go, not in the workspace, not to be rewritten, got %v", err)
+	}
+}
+
+func TestAnalyzeReportsLoadErrors(t *testing.T) {
+	t.Setenv("GOFLAGS", "-mod=mod")
+	dir := copyGolden(t, "workspace")
+	logger := newTestLogger(io.Discard, slog.LevelError)
+	report, err := fxforce5.NewAnalyzer(dir, nil, fxforce5.WithCacheDir(""), fxforce5.WithLogger(logger)).Analyze()
+	if err == nil {
+		t.Fatal("expected the run to fail")
+	}
+	// The go command fails for each module of the workspace.
+	diagnostics := make([]string, 0)
+	for _, p := range report.Packages {
+		for _, d := range p.Diagnostics {
+			if d.Severity == fxforce5.SEVERITY_ERROR && d.Code == fxforce5.DIAG_LOAD && strings.Contains(d.Message, "-mod may only be set to readonly or vendor") {
+				diagnostics = append(diagnostics, d.Pos.Filename)
+			}
+		}
+	}
+	sort.Strings(diagnostics)
+	if strings.Join(diagnostics, " ") != "app lib" || report.Errors() != 2 {
+		t.Errorf("expected load errors for app and lib, got %+v", report.Packages)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "app", "server", "server_new.go")); !os.IsNotExist(err) {
+		t.Errorf("expected app/server/server.go not to be rewritten, got %v", err)
+	}
+}
+
+func TestGoldenSelection(t *testing.T) {
+	_, report := runGolden(t, "selection", fxforce5.WithExclude("internal/**/mocks/*.go"), fxforce5.WithGitignore())
+	skipped := make([]string, 0)
+	for _, p := range report.Packages {
+		for _, s := range p.Skipped {
+			skipped = append(skipped, s.Path+": "+s.Reason)
+		}
+	}
+	sort.Strings(skipped)
+	expected := []string{
+		"gen: gitignored",
+		"internal/api/handler_local.go: gitignored",
+		"internal/svc/mocks/server.go: excluded by internal/**/mocks/*.go",
+	}
+	if strings.Join(skipped, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected %v to be skipped, got %v", expected, skipped)
+	}
+}
+
+func TestAnalyzeSelection(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []fxforce5.Option
+		expected []string
+	}{
+		{
+			name:     "include",
+			opts:     []fxforce5.Option{fxforce5.WithInclude("internal/**/server.go")},
+			expected: []string{"internal/svc/mocks/server_new.go", "internal/svc/server_new.go"},
+		},
+		{
+			name:     "packages",
+			opts:     []fxforce5.Option{fxforce5.WithPackages("example.com/selection/internal/api/...")},
+			expected: []string{"internal/api/handler_local_new.go", "internal/api/handler_new.go"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := copyGolden(t, "selection")
+			opts := append([]fxforce5.Option{fxforce5.WithCacheDir(""), fxforce5.WithLogger(newTestLogger(io.Discard, slog.LevelWarn))}, tc.opts...)
+			_, err := fxforce5.NewAnalyzer(dir, nil, opts...).Analyze()
+			if err != nil {
+				t.Fatal(err)
+			}
+			written := make([]string, 0)
+			for _, path := range writtenFiles(t, filepath.Join("data", "golden", "selection"), dir) {
+				if strings.HasSuffix(path, "_new.go") {
+					written = append(written, filepath.ToSlash(path))
+				}
+			}
+			if strings.Join(written, "\n") != strings.Join(tc.expected, "\n") {
+				t.Errorf("expected %v to be rewritten, got %v", tc.expected, written)
+			}
+		})
+	}
+}